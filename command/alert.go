@@ -0,0 +1,254 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jdxj/v2ray-bot/logger"
+)
+
+// 节点至少有这么多次测速结果才检查可用率
+const alertMinSamples = 5
+
+var (
+	alertAvailability     float64
+	nameAlertAvailability = "alert-availability"
+
+	alertExpire     time.Duration
+	nameAlertExpire = "alert-expire"
+
+	alertTraffic     float64
+	nameAlertTraffic = "alert-traffic"
+
+	alertBestMargin     time.Duration
+	nameAlertBestMargin = "alert-best-margin"
+)
+
+// alertWatcher 比较 daemon 每次任务的结果, 状态变化时发送告警,
+// 同一个问题只告警一次, 恢复后才会再次告警
+type alertWatcher struct {
+	ctx   context.Context
+	sinks []*notifySink
+
+	availability float64
+	expireWithin time.Duration
+	trafficRatio float64
+	bestMargin   time.Duration
+
+	// sendMu 保证告警按产生的顺序发送
+	sendMu sync.Mutex
+
+	mu sync.Mutex
+	// 等待发送的告警, 在释放 mu 之后发送, 避免慢的发送方式阻塞 daemon 的任务
+	pending []*notification
+	best    string
+	// 节点 id 到最近的测速结果
+	records map[string]*nodeRecord
+	low     map[string]bool
+	// 订阅地址到已经告警的问题
+	failing  map[string]bool
+	expiring map[string]bool
+	traffic  map[string]bool
+}
+
+func newAlertWatcher(ctx context.Context, sinks []*notifySink) *alertWatcher {
+	return &alertWatcher{
+		ctx:          ctx,
+		sinks:        sinks,
+		availability: alertAvailability,
+		expireWithin: alertExpire,
+		trafficRatio: alertTraffic,
+		bestMargin:   alertBestMargin,
+		records:      make(map[string]*nodeRecord),
+		low:          make(map[string]bool),
+		failing:      make(map[string]bool),
+		expiring:     make(map[string]bool),
+		traffic:      make(map[string]bool),
+	}
+}
+
+// Seed 使用上一次运行保存的状态, 避免启动时重复告警
+func (a *alertWatcher) Seed(state *daemonState) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return state.view(func() {
+		if best := bestResult(state.Ranking); best != nil {
+			a.best = best.ID
+		}
+		for u, st := range state.Subscriptions {
+			a.failing[u] = st.Error != ""
+			if st.UserInfo != nil {
+				a.expiring[u] = a.isExpiring(st.UserInfo)
+				a.traffic[u] = a.isExhausted(st.UserInfo)
+			}
+		}
+	})
+}
+
+func (a *alertWatcher) isExpiring(info *subscriptionUserInfo) bool {
+	return !info.Expire.IsZero() && time.Until(info.Expire) < a.expireWithin
+}
+
+func (a *alertWatcher) isExhausted(info *subscriptionUserInfo) bool {
+	return info.Total > 0 && info.UsedRatio() >= a.trafficRatio
+}
+
+// send 把告警放入队列, 调用方需要持有 mu
+func (a *alertWatcher) send(kind, title, text string) {
+	a.pending = append(a.pending, &notification{Kind: kind, Title: title, Text: redact(text), Time: time.Now()})
+}
+
+// flush 发送队列中的告警, 调用方不能持有 mu
+func (a *alertWatcher) flush() {
+	a.sendMu.Lock()
+	defer a.sendMu.Unlock()
+
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = nil
+	a.mu.Unlock()
+
+	for _, n := range pending {
+		for _, s := range a.sinks {
+			if err := s.notify(a.ctx, n); err != nil {
+				logger.Errorw("send notification failed", "sink", s.name, "kind", n.Kind, "err", err)
+			}
+		}
+	}
+}
+
+func bestResult(ranking *rankingState) *rankingResult {
+	if ranking == nil {
+		return nil
+	}
+	// 排名已经按延迟排序, 失败的在最后
+	for _, r := range ranking.Results {
+		if r.Error == "" {
+			return r
+		}
+	}
+	return nil
+}
+
+// bestChanged 判断是否需要告警最优节点的变化, 延迟相近的节点会交替成为最优,
+// 只有上次告警的最优节点失败或者比 best 慢超过 bestMargin 时才告警
+func (a *alertWatcher) bestChanged(ranking *rankingState, best *rankingResult) bool {
+	if a.best == "" {
+		return true
+	}
+	for _, r := range ranking.Results {
+		if r.ID == a.best {
+			return r.Error != "" || time.Duration(r.DelayMs-best.DelayMs)*time.Millisecond > a.bestMargin
+		}
+	}
+	// 已经不在订阅中
+	return true
+}
+
+// ObserveRanking 检查最优节点的变化和每个节点的可用率
+func (a *alertWatcher) ObserveRanking(ranking *rankingState) {
+	if a == nil {
+		return
+	}
+	defer a.flush()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	best := bestResult(ranking)
+	switch {
+	case best == nil && a.best != "":
+		a.best = ""
+		a.send(notifyAllDown, "all nodes are down",
+			fmt.Sprintf("none of %d nodes can reach %s", len(ranking.Results), ranking.ProbeURL))
+	case best != nil && best.ID != a.best && a.bestChanged(ranking, best):
+		text := fmt.Sprintf("%s (%s:%d) %dms", best.Node, best.Add, best.Port, best.DelayMs)
+		if a.best == "" {
+			text += ", nodes are reachable again"
+		}
+		a.best = best.ID
+		a.send(notifyBestChanged, "best node changed", text)
+	}
+
+	records := make(map[string]*nodeRecord, len(ranking.Results))
+	for _, r := range ranking.Results {
+		record := a.records[r.ID]
+		if record == nil {
+			record = &nodeRecord{}
+		}
+		records[r.ID] = record
+		record.add(r.Error == "", ranking.CheckedAt)
+		if len(record.results) < alertMinSamples {
+			continue
+		}
+
+		ratio := record.ratio()
+		switch {
+		case ratio < a.availability && !a.low[r.ID]:
+			a.low[r.ID] = true
+			a.send(notifyAvailabilityLow, "node availability dropped",
+				fmt.Sprintf("%s (%s:%d) %.0f%% of the last %d checks succeeded",
+					r.Node, r.Add, r.Port, ratio*100, len(record.results)))
+		case ratio >= a.availability && a.low[r.ID]:
+			delete(a.low, r.ID)
+			a.send(notifyAvailabilityOK, "node availability recovered",
+				fmt.Sprintf("%s (%s:%d) %.0f%% of the last %d checks succeeded",
+					r.Node, r.Add, r.Port, ratio*100, len(record.results)))
+		}
+	}
+	// 已经不在订阅中的节点
+	for id := range a.low {
+		if records[id] == nil {
+			delete(a.low, id)
+		}
+	}
+	a.records = records
+}
+
+// ObserveSubscriptions 检查订阅的拉取结果, 到期时间和流量
+func (a *alertWatcher) ObserveSubscriptions(states map[string]*subscriptionState) {
+	if a == nil {
+		return
+	}
+	defer a.flush()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for u, st := range states {
+		source := sourceLabel(u)
+		switch {
+		case st.Error != "" && !a.failing[u]:
+			a.failing[u] = true
+			text := st.Error
+			if st.Stale {
+				text += ", using cached copy"
+			}
+			a.send(notifySubscriptionFailed, "subscription fetch failed: "+source, text)
+		case st.Error == "" && a.failing[u]:
+			a.failing[u] = false
+			a.send(notifySubscriptionOK, "subscription recovered: "+source,
+				fmt.Sprintf("%d nodes", st.Nodes))
+		}
+
+		info := st.UserInfo
+		if info == nil {
+			continue
+		}
+		expiring := a.isExpiring(info)
+		if expiring && !a.expiring[u] {
+			a.send(notifySubscriptionExpire, "subscription expiring: "+source,
+				fmt.Sprintf("expires at %s", info.Expire.Format("2006-01-02 15:04")))
+		}
+		a.expiring[u] = expiring
+
+		exhausted := a.isExhausted(info)
+		if exhausted && !a.traffic[u] {
+			a.send(notifySubscriptionTraffic, "subscription traffic running out: "+source,
+				fmt.Sprintf("%.0f%% used, %s of %s", info.UsedRatio()*100,
+					formatBytes(info.Upload+info.Download), formatBytes(info.Total)))
+		}
+		a.traffic[u] = exhausted
+	}
+}
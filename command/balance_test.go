@@ -0,0 +1,134 @@
+package command
+
+import (
+	"reflect"
+	"testing"
+
+	core "github.com/v2fly/v2ray-core/v5"
+	"github.com/v2fly/v2ray-core/v5/app/observatory"
+	"github.com/v2fly/v2ray-core/v5/common/serial"
+	"github.com/v2fly/v2ray-core/v5/features/routing"
+)
+
+func TestNewBalancingRule(t *testing.T) {
+	cases := []struct {
+		strategy string
+		want     string
+		fallback string
+	}{
+		// fastest 和 roundrobin 由 nodeSelector 覆盖负载均衡器的选择
+		{strategy: balanceFastest, want: "random"},
+		{strategy: balanceRandom, want: "random"},
+		{strategy: balanceRoundRobin, want: "random"},
+		{strategy: balanceLeastPing, want: "leastping", fallback: "node-0"},
+	}
+	for _, c := range cases {
+		rule, err := newBalancingRule(c.strategy)
+		if err != nil {
+			t.Fatalf("%s: %s\n", c.strategy, err)
+		}
+		if rule.Tag != balancerTag || !reflect.DeepEqual(rule.OutboundSelector, []string{nodeTagPrefix}) {
+			t.Fatalf("%s: rule: %+v\n", c.strategy, rule)
+		}
+		if rule.Strategy != c.want || rule.FallbackTag != c.fallback {
+			t.Fatalf("%s: strategy: %s, fallback: %s\n", c.strategy, rule.Strategy, rule.FallbackTag)
+		}
+		if (rule.StrategySettings != nil) != (c.strategy == balanceLeastPing) {
+			t.Fatalf("%s: strategy settings: %v\n", c.strategy, rule.StrategySettings)
+		}
+	}
+
+	if _, err := newBalancingRule("fast"); err == nil {
+		t.Fatalf("want err for unknown strategy\n")
+	}
+}
+
+func hasObservatory(cfg *core.Config) bool {
+	for _, app := range cfg.App {
+		msg, err := serial.GetInstanceOf(app)
+		if err != nil {
+			continue
+		}
+		if _, ok := msg.(*observatory.Config); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func TestGetProxyConfigBalance(t *testing.T) {
+	defer func() { balanceStrategy = balanceFastest }()
+
+	vmesses := []*vmess{
+		{Ps: "hk", Add: "127.0.0.1", Port: 443, Id: "0c8d2f4e-1b3a-4c5d-8e9f-0a1b2c3d4e5f"},
+		{Ps: "jp", Add: "127.0.0.2", Port: 443, Id: "0c8d2f4e-1b3a-4c5d-8e9f-0a1b2c3d4e5f"},
+	}
+	for _, strategy := range []string{balanceFastest, balanceRandom, balanceRoundRobin, balanceLeastPing} {
+		balanceStrategy = strategy
+		cfg, err := getProxyConfig(vmesses)
+		if err != nil {
+			t.Fatalf("%s: %s\n", strategy, err)
+		}
+		// 每个节点有一个参与负载均衡的出站和一个测速专用的出站
+		var tags []string
+		for _, outbound := range cfg.Outbound {
+			tags = append(tags, outbound.Tag)
+		}
+		if want := []string{"node-0", "probe-0", "node-1", "probe-1"}; !reflect.DeepEqual(tags, want) {
+			t.Fatalf("%s: outbounds: %v\n", strategy, tags)
+		}
+		// 只有 leastping 由 observatory 测速
+		if hasObservatory(cfg) != (strategy == balanceLeastPing) {
+			t.Fatalf("%s: observatory: %v\n", strategy, hasObservatory(cfg))
+		}
+	}
+
+	balanceStrategy = "fast"
+	if _, err := getProxyConfig(vmesses); err == nil {
+		t.Fatalf("want err for unknown strategy\n")
+	}
+}
+
+func TestNodeSelectorRoundRobin(t *testing.T) {
+	defer func() { balanceStrategy = balanceFastest }()
+	balanceStrategy = balanceRoundRobin
+
+	vmesses := []*vmess{
+		{Ps: "hk", Add: "127.0.0.1", Port: 443, Id: "0c8d2f4e-1b3a-4c5d-8e9f-0a1b2c3d4e5f"},
+		{Ps: "jp", Add: "127.0.0.2", Port: 443, Id: "0c8d2f4e-1b3a-4c5d-8e9f-0a1b2c3d4e5f"},
+		{Ps: "us", Add: "127.0.0.3", Port: 443, Id: "0c8d2f4e-1b3a-4c5d-8e9f-0a1b2c3d4e5f"},
+	}
+	cfg, err := getProxyConfig(vmesses)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	// 不需要启动, 只检查负载均衡器的覆盖目标
+	ins, err := core.New(cfg)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer ins.Close()
+	overrider := ins.GetFeature(routing.RouterType()).(routing.BalancerOverrider)
+
+	s := newNodeSelector(ins, balanceRoundRobin, vmesses)
+	// jp 已经被移出负载均衡器, 轮换时跳过
+	s.active[1] = false
+	for _, want := range []int{0, 2, 0} {
+		if err := s.Check(); err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		target, err := overrider.GetOverrideTarget(balancerTag)
+		if err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		if s.current != want || target != nodeTag(want) {
+			t.Fatalf("current: %d, target: %s, want: %d\n", s.current, target, want)
+		}
+	}
+
+	// random 模式下 Check 不轮换节点
+	s.strategy = balanceRandom
+	if err := s.Check(); err != nil || s.current != 0 {
+		t.Fatalf("random: current: %d, err: %v\n", s.current, err)
+	}
+}
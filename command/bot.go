@@ -0,0 +1,517 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/adrg/xdg"
+	"github.com/jdxj/v2ray-bot/logger"
+	"github.com/spf13/cobra"
+)
+
+var bot = &cobra.Command{
+	Use:        "bot",
+	Aliases:    nil,
+	SuggestFor: nil,
+	Short:      "run a telegram bot for parse, ping and download",
+	Long: `example:
+  bot --token 123:abc --allow-chat 10001,10002
+  bot --token 123:abc --allow-chat 10001 --api-url http://127.0.0.1:8081
+
+commands:
+  /sub add|remove <url>, /sub list
+  /nodes
+  /ping [url]
+  /best
+  /download [source]`,
+	Example:                    "",
+	ValidArgs:                  nil,
+	ValidArgsFunction:          nil,
+	Args:                       cobra.NoArgs,
+	ArgAliases:                 nil,
+	BashCompletionFunction:     "",
+	Deprecated:                 "",
+	Annotations:                nil,
+	Version:                    "",
+	PersistentPreRun:           nil,
+	PersistentPreRunE:          nil,
+	PreRun:                     nil,
+	PreRunE:                    nil,
+	Run:                        botRun,
+	RunE:                       nil,
+	PostRun:                    nil,
+	PostRunE:                   nil,
+	PersistentPostRun:          nil,
+	PersistentPostRunE:         nil,
+	FParseErrWhitelist:         cobra.FParseErrWhitelist{},
+	CompletionOptions:          cobra.CompletionOptions{},
+	TraverseChildren:           false,
+	Hidden:                     false,
+	SilenceErrors:              false,
+	SilenceUsage:               false,
+	DisableFlagParsing:         false,
+	DisableAutoGenTag:          false,
+	DisableFlagsInUseLine:      false,
+	DisableSuggestions:         false,
+	SuggestionsMinimumDistance: 0,
+}
+
+var (
+	botToken     string
+	nameBotToken = "token"
+
+	telegramURL     string
+	nameTelegramURL = "api-url"
+
+	allowChats     []int64
+	nameAllowChats = "allow-chat"
+
+	pollTimeout     time.Duration
+	namePollTimeout = "poll-timeout"
+)
+
+func init() {
+	rootCmd.AddCommand(bot)
+
+	bot.Flags().
+		StringVar(&botToken, nameBotToken, "", "telegram bot token")
+
+	bot.Flags().
+		StringVar(&telegramURL, nameTelegramURL, telegramAPI, "telegram bot api server")
+
+	bot.Flags().
+		Int64SliceVar(&allowChats, nameAllowChats, nil, "chat ids allowed to use the bot, others are ignored")
+
+	bot.Flags().
+		DurationVar(&pollTimeout, namePollTimeout, 30*time.Second, "long polling timeout of getUpdates")
+
+	bot.Flags().
+		StringVar(&probeURL, nameProbeURL, "https://www.google.com/generate_204", "url used by /ping and /best")
+
+	bot.Flags().
+		DurationVar(&pingTimeout, namePingTimeout, 10*time.Second, "timeout of each ping")
+
+	bot.Flags().
+		StringVar(&via, nameVia, "env", "how /download reaches the network: direct, env or node=<name>")
+
+	bot.Flags().
+		StringVar(&source, nameSource, "loyalsoldier", "default geo data source of /download")
+
+	bot.Flags().
+		StringVar(&sourcesFile, nameSourcesFile, "", "json file with custom geo data sources")
+
+	bot.Flags().
+		BoolVar(&saveHistory, nameSaveHistory, true, "save results to the history database (history cmd)")
+}
+
+const (
+	botStoreFile = "bot.json"
+
+	botHelp = `/sub add <url> - add a subscription
+/sub remove <url> - remove a subscription
+/sub list - list subscriptions
+/nodes - list nodes of all subscriptions
+/ping [url] - ping all nodes
+/best - share link of the fastest node
+/download [source] - update geoip.dat and geosite.dat`
+)
+
+// botStore 保存 bot 的订阅地址
+type botStore struct {
+	path          string
+	Subscriptions []string `json:"subscriptions"`
+}
+
+// botStoreMu 保护进程内 bot.json 的读取-修改-保存, 进程之间由 bot.json.lock 保护,
+// bot 和 serve 的 api 会同时修改订阅
+var botStoreMu sync.Mutex
+
+func loadBotStore() (*botStore, error) {
+	path, err := xdg.DataFile(filepath.Join(appName, botStoreFile))
+	if err != nil {
+		return nil, err
+	}
+	s := &botStore{path: path}
+
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s, s.load()
+}
+
+func (s *botStore) lock() (func(), error) {
+	botStoreMu.Lock()
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		botStoreMu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		botStoreMu.Unlock()
+	}, nil
+}
+
+func (s *botStore) load() error {
+	s.Subscriptions = nil
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, s)
+}
+
+// save 保存到 bot.json, 订阅地址中有 token, 只允许自己读写
+func (s *botStore) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// update 重新读取 bot.json, f 返回 true 时保存修改
+func (s *botStore) update(f func() bool) (bool, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	if !f() {
+		return false, nil
+	}
+	return true, s.save()
+}
+
+// List 返回最新的订阅
+func (s *botStore) List() ([]string, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return append([]string(nil), s.Subscriptions...), nil
+}
+
+// Add 添加订阅, 已存在时返回 false
+func (s *botStore) Add(url string) (bool, error) {
+	return s.update(func() bool {
+		for _, u := range s.Subscriptions {
+			if u == url {
+				return false
+			}
+		}
+		s.Subscriptions = append(s.Subscriptions, url)
+		return true
+	})
+}
+
+// Remove 删除订阅, 不存在时返回 false
+func (s *botStore) Remove(url string) (bool, error) {
+	return s.update(func() bool {
+		for i, u := range s.Subscriptions {
+			if u == url {
+				s.Subscriptions = append(s.Subscriptions[:i], s.Subscriptions[i+1:]...)
+				return true
+			}
+		}
+		return false
+	})
+}
+
+type telegramBot struct {
+	tg    *telegramClient
+	store *botStore
+	allow map[int64]bool
+}
+
+func newTelegramBot(tg *telegramClient, store *botStore, allow []int64) *telegramBot {
+	b := &telegramBot{
+		tg:    tg,
+		store: store,
+		allow: make(map[int64]bool),
+	}
+	for _, id := range allow {
+		b.allow[id] = true
+	}
+	return b
+}
+
+// Run 循环拉取消息直到 ctx 结束, 消息按顺序处理
+func (b *telegramBot) Run(ctx context.Context) {
+	var offset int64
+	for {
+		updates, err := b.tg.GetUpdates(ctx, offset, pollTimeout)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Errorw("get updates failed", "err", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message == nil || u.Message.Text == "" {
+				continue
+			}
+			chatID := u.Message.Chat.ID
+			if !b.allow[chatID] {
+				logger.Warnw("ignore message from chat not allowed", "chat", chatID)
+				continue
+			}
+
+			reply := b.Handle(u.Message.Text)
+			if err := b.tg.SendMessage(ctx, chatID, reply); err != nil {
+				logger.Errorw("send message failed", "chat", chatID, "err", err)
+			}
+		}
+	}
+}
+
+// Handle 执行一条命令并返回回复的内容
+func (b *telegramBot) Handle(text string) string {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return botHelp
+	}
+	// 群组中的命令带有 @botname 后缀
+	command, _, _ := strings.Cut(fields[0], "@")
+	args := fields[1:]
+
+	switch command {
+	case "/start", "/help":
+		return botHelp
+	case "/sub":
+		return b.handleSub(args)
+	case "/nodes":
+		return b.handleNodes()
+	case "/ping":
+		url := probeURL
+		if len(args) > 0 {
+			url = args[0]
+		}
+		return b.handlePing(url)
+	case "/best":
+		return b.handleBest()
+	case "/download":
+		name := source
+		if len(args) > 0 {
+			name = args[0]
+		}
+		return b.handleDownload(name)
+	}
+	return fmt.Sprintf("unknown command: %s\n\n%s", command, botHelp)
+}
+
+func (b *telegramBot) handleSub(args []string) string {
+	if len(args) == 0 {
+		return "usage: /sub add|remove <url>, /sub list"
+	}
+
+	switch args[0] {
+	case "list":
+		urls, err := b.store.List()
+		if err != nil {
+			return fmt.Sprintf("load subscriptions err: %s", err)
+		}
+		if len(urls) == 0 {
+			return "no subscription"
+		}
+		var lines []string
+		for i, u := range urls {
+			lines = append(lines, fmt.Sprintf("%d. %s", i+1, u))
+		}
+		return strings.Join(lines, "\n")
+	case "add":
+		if len(args) != 2 {
+			return "usage: /sub add <url>"
+		}
+		vmesses, _, err := parseFromURL(args[1])
+		if err != nil {
+			return fmt.Sprintf("parse subscription err: %s", err)
+		}
+		added, err := b.store.Add(args[1])
+		if err != nil {
+			return fmt.Sprintf("save subscription err: %s", err)
+		}
+		if !added {
+			return "subscription already exists"
+		}
+		return fmt.Sprintf("subscription added, %d nodes", len(vmesses))
+	case "remove":
+		if len(args) != 2 {
+			return "usage: /sub remove <url>"
+		}
+		removed, err := b.store.Remove(args[1])
+		if err != nil {
+			return fmt.Sprintf("save subscription err: %s", err)
+		}
+		if !removed {
+			return "subscription not found"
+		}
+		return "subscription removed"
+	}
+	return "usage: /sub add|remove <url>, /sub list"
+}
+
+// loadNodes 合并所有订阅中的有效节点, notes 是需要告知用户的问题
+func (b *telegramBot) loadNodes() ([]*vmess, []string) {
+	urls, err := b.store.List()
+	if err != nil {
+		return nil, []string{fmt.Sprintf("load subscriptions err: %s", err)}
+	}
+
+	var (
+		result []*vmess
+		notes  []string
+	)
+	for _, u := range urls {
+		vmesses, sub, err := parseFromURL(u)
+		if err != nil {
+			notes = append(notes, fmt.Sprintf("%s: %s", u, err))
+			continue
+		}
+		if sub.Stale {
+			notes = append(notes, fmt.Sprintf("%s: %s, using cached copy (age %s)", u, sub.Err, sub.Age()))
+		}
+		result = append(result, filterValidVmess(vmesses)...)
+	}
+	return result, notes
+}
+
+func withNotes(text string, notes []string) string {
+	if len(notes) == 0 {
+		return text
+	}
+	return text + "\n\n" + strings.Join(notes, "\n")
+}
+
+func (b *telegramBot) handleNodes() string {
+	if urls, err := b.store.List(); err == nil && len(urls) == 0 {
+		return "no subscription, use /sub add <url>"
+	}
+
+	vmesses, notes := b.loadNodes()
+	if len(vmesses) == 0 {
+		return withNotes("no node", notes)
+	}
+	lines := make([]string, 0, len(vmesses))
+	for i, v := range vmesses {
+		lines = append(lines, fmt.Sprintf("%3d. %s (%s:%d)", i+1, v.Ps, v.Add, v.Port))
+	}
+	return withNotes(strings.Join(lines, "\n"), notes)
+}
+
+func (b *telegramBot) ping(url string) ([]pingStat, []string, error) {
+	vmesses, notes := b.loadNodes()
+	checkedAt := time.Now()
+	stats, err := pingVmesses(vmesses, url)
+	if err == nil {
+		recordHistory(func(h *historyDB) error {
+			return h.RecordSamples(stats, url, checkedAt)
+		})
+	}
+	return stats, notes, err
+}
+
+func (b *telegramBot) handlePing(url string) string {
+	stats, notes, err := b.ping(url)
+	if err != nil {
+		return withNotes(fmt.Sprintf("ping err: %s", err), notes)
+	}
+	lines := make([]string, 0, len(stats))
+	for i, s := range stats {
+		lines = append(lines, fmt.Sprintf("%3d. %s", i+1, s))
+	}
+	return withNotes(strings.Join(lines, "\n"), notes)
+}
+
+func (b *telegramBot) handleBest() string {
+	stats, notes, err := b.ping(probeURL)
+	if err != nil {
+		return withNotes(fmt.Sprintf("ping err: %s", err), notes)
+	}
+	if stats[0].err != nil {
+		return withNotes("all nodes failed", notes)
+	}
+	return withNotes(fmt.Sprintf("%s\n%s", stats[0], stats[0].v.ShareLink()), notes)
+}
+
+func (b *telegramBot) handleDownload(name string) string {
+	c, closeClient, err := getDownloadClient(via)
+	if err != nil {
+		return fmt.Sprintf("get http client err: %s", err)
+	}
+	defer closeClient()
+
+	manifest, err := loadGeoManifest(output)
+	if err != nil {
+		return fmt.Sprintf("load geo manifest err: %s", err)
+	}
+
+	tasks, upToDate, err := getGeoTasks(c, manifest, name)
+	if err != nil {
+		return fmt.Sprintf("get geo data release err: %s", err)
+	}
+
+	buf := &strings.Builder{}
+	for _, r := range upToDate {
+		fmt.Fprintf(buf, "%s is up to date (%s %s)\n", r.Asset.File, r.Source, r.Tag)
+	}
+	errs := runDownloadTasks(c, manifest, tasks, parallel, nil)
+	for _, err := range errs {
+		fmt.Fprintln(buf, err)
+	}
+	fmt.Fprintf(buf, "%d/%d files downloaded", len(tasks)-len(errs), len(tasks))
+	return buf.String()
+}
+
+func botRun(cmd *cobra.Command, args []string) {
+	if botToken == "" {
+		cmd.PrintErrln("--token is required")
+		return
+	}
+	if len(allowChats) == 0 {
+		logger.Warnw("no --allow-chat, all messages will be ignored")
+	}
+
+	store, err := loadBotStore()
+	if err != nil {
+		cmd.PrintErrf("load bot store err: %s\n", err)
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tg := newTelegramClient(telegramURL, botToken, pollTimeout)
+	newTelegramBot(tg, store, allowChats).Run(ctx)
+}
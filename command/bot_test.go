@@ -0,0 +1,169 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTelegram 模拟 Bot API, 依次返回 batches 中的消息, 之后结束 bot
+type fakeTelegram struct {
+	mu      sync.Mutex
+	batches [][]tgUpdate
+	sent    []map[string]interface{}
+	stop    func()
+}
+
+func (f *fakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var result interface{} = true
+	switch r.URL.Path {
+	case "/bottest-token/getUpdates":
+		if len(f.batches) == 0 {
+			f.stop()
+			result = []tgUpdate{}
+			break
+		}
+		result = f.batches[0]
+		f.batches = f.batches[1:]
+	case "/bottest-token/sendMessage":
+		params := make(map[string]interface{})
+		_ = json.NewDecoder(r.Body).Decode(&params)
+		f.sent = append(f.sent, params)
+	default:
+		_ = json.NewEncoder(w).Encode(tgResponse{OK: false, Description: "Not Found"})
+		return
+	}
+
+	data, _ := json.Marshal(result)
+	_ = json.NewEncoder(w).Encode(tgResponse{OK: true, Result: data})
+}
+
+func newTgUpdate(id, chatID int64, text string) tgUpdate {
+	return tgUpdate{
+		UpdateID: id,
+		Message:  &tgMessage{MessageID: id, Chat: tgChat{ID: chatID}, Text: text},
+	}
+}
+
+func TestTelegramBot(t *testing.T) {
+	setXDGDir(t, "XDG_CACHE_HOME", t.TempDir())
+	setXDGDir(t, "XDG_DATA_HOME", t.TempDir())
+
+	share := newShare(
+		&vmess{Ps: "a", Id: "2015cdb0-4f09-4796-7ec6-91b2e5dc2923", Add: "a.example.com", Port: 443},
+		&vmess{Ps: "b", Id: "2015cdb0-4f09-4796-7ec6-91b2e5dc2923", Add: "b.example.com", Port: 8443},
+	)
+	sub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(share)
+	}))
+	defer sub.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fake := &fakeTelegram{
+		batches: [][]tgUpdate{
+			{
+				newTgUpdate(1, 100, "/sub add "+sub.URL),
+				newTgUpdate(2, 200, "/sub list"),
+			},
+			{
+				newTgUpdate(3, 100, "/nodes@test_bot"),
+				newTgUpdate(4, 100, "/sub add "+sub.URL),
+			},
+			{
+				newTgUpdate(5, 100, "/sub remove "+sub.URL),
+				newTgUpdate(6, 100, "/sub list"),
+				newTgUpdate(7, 100, "/unknown"),
+			},
+		},
+		stop: cancel,
+	}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	store, err := loadBotStore()
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	tg := newTelegramClient(srv.URL, "test-token", time.Second)
+	newTelegramBot(tg, store, []int64{100}).Run(ctx)
+
+	want := []string{
+		"subscription added, 2 nodes",
+		"  1. a (a.example.com:443)\n  2. b (b.example.com:8443)",
+		"subscription already exists",
+		"subscription removed",
+		"no subscription",
+		"unknown command: /unknown",
+	}
+	if len(fake.sent) != len(want) {
+		t.Fatalf("sent %d messages: %v\n", len(fake.sent), fake.sent)
+	}
+	for i, msg := range fake.sent {
+		if msg["chat_id"] != float64(100) {
+			t.Fatalf("message %d sent to %v\n", i, msg["chat_id"])
+		}
+		if text := msg["text"].(string); !strings.HasPrefix(text, want[i]) {
+			t.Fatalf("message %d: %q, want %q\n", i, text, want[i])
+		}
+	}
+
+	// 订阅保存在 XDG_DATA_HOME 中
+	store, err = loadBotStore()
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if len(store.Subscriptions) != 0 {
+		t.Fatalf("subscriptions: %v\n", store.Subscriptions)
+	}
+
+	// bot 和 api 使用不同的 botStore 同时添加订阅
+	other, err := loadBotStore()
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := store
+			if i%2 == 1 {
+				s = other
+			}
+			if _, err := s.Add(fmt.Sprintf("https://sub.example.com/%d", i)); err != nil {
+				t.Errorf("%s\n", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if urls, err := store.List(); err != nil || len(urls) != 10 {
+		t.Fatalf("urls: %v, err: %v\n", urls, err)
+	}
+	info, err := os.Stat(store.path)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("mode: %s\n", info.Mode())
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	text := strings.Repeat("a", 6) + "\n" + strings.Repeat("b", 3) + "\n" + strings.Repeat("测", 5)
+	chunks := splitMessage(text, 8)
+	want := []string{"aaaaaa\n", "bbb\n", "测测", "测测", "测"}
+	if strings.Join(chunks, "|") != strings.Join(want, "|") {
+		t.Fatalf("chunks: %q\n", chunks)
+	}
+}
@@ -0,0 +1,250 @@
+package command
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adrg/xdg"
+	"github.com/jdxj/v2ray-bot/logger"
+)
+
+const (
+	appName = "v2ray-bot"
+)
+
+var subscriptionClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// subscription 是订阅内容在本地的缓存
+type subscription struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag"`
+	LastModified string    `json:"last_modified"`
+	FetchedAt    time.Time `json:"fetched_at"`
+	// UserInfo 来自 Subscription-Userinfo 响应头, 没有时为 nil
+	UserInfo *subscriptionUserInfo `json:"user_info,omitempty"`
+
+	Body []byte `json:"-"`
+	// Stale 为 true 时表示订阅地址不可用, Body 来自上一次成功的缓存
+	Stale bool  `json:"-"`
+	Err   error `json:"-"`
+}
+
+func (s *subscription) Age() time.Duration {
+	return time.Since(s.FetchedAt).Round(time.Second)
+}
+
+// subscriptionUserInfo 是机场返回的流量和到期时间, 单位是字节
+type subscriptionUserInfo struct {
+	Upload   int64     `json:"upload"`
+	Download int64     `json:"download"`
+	Total    int64     `json:"total"`
+	Expire   time.Time `json:"expire,omitempty"`
+}
+
+// UsedRatio 返回已用流量的比例, 没有总量时为 0
+func (u *subscriptionUserInfo) UsedRatio() float64 {
+	if u.Total <= 0 {
+		return 0
+	}
+	return float64(u.Upload+u.Download) / float64(u.Total)
+}
+
+// parseSubscriptionUserInfo 解析形如
+// upload=455727941; download=6174315083; total=1073741824000; expire=1671815872 的响应头
+func parseSubscriptionUserInfo(header string) *subscriptionUserInfo {
+	if header == "" {
+		return nil
+	}
+	info := &subscriptionUserInfo{}
+	for _, field := range strings.Split(header, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "upload":
+			info.Upload = n
+		case "download":
+			info.Download = n
+		case "total":
+			info.Total = n
+		case "expire":
+			if n > 0 {
+				info.Expire = time.Unix(n, 0)
+			}
+		}
+	}
+	return info
+}
+
+func subscriptionCachePath(url, ext string) (string, error) {
+	sum := sha256.Sum256([]byte(url))
+	key := hex.EncodeToString(sum[:8])
+	return xdg.CacheFile(filepath.Join(appName, "subscriptions", key+ext))
+}
+
+func loadSubscriptionCache(url string) (*subscription, error) {
+	metaPath, err := subscriptionCachePath(url, ".json")
+	if err != nil {
+		return nil, err
+	}
+	bodyPath, err := subscriptionCachePath(url, ".body")
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, err
+	}
+	sub := &subscription{}
+	if err := json.Unmarshal(meta, sub); err != nil {
+		return nil, err
+	}
+	sub.Body, err = os.ReadFile(bodyPath)
+	return sub, err
+}
+
+func saveSubscriptionCache(sub *subscription, bodyChanged bool) error {
+	metaPath, err := subscriptionCachePath(sub.URL, ".json")
+	if err != nil {
+		return err
+	}
+	bodyPath, err := subscriptionCachePath(sub.URL, ".body")
+	if err != nil {
+		return err
+	}
+
+	if bodyChanged {
+		if err := writeFileAtomic(bodyPath, sub.Body); err != nil {
+			return err
+		}
+	}
+
+	meta, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(metaPath, meta)
+}
+
+var (
+	fetchLocksMu sync.Mutex
+	fetchLocks   = make(map[string]*sync.Mutex)
+)
+
+// fetchLock 返回订阅地址的锁, 同一个订阅同时只有一个请求读写缓存
+func fetchLock(url string) *sync.Mutex {
+	fetchLocksMu.Lock()
+	defer fetchLocksMu.Unlock()
+
+	l, ok := fetchLocks[url]
+	if !ok {
+		l = &sync.Mutex{}
+		fetchLocks[url] = l
+	}
+	return l
+}
+
+// fetchSubscription 使用 ETag/Last-Modified 条件请求订阅地址,
+// 订阅地址不可用时退回到上一次成功的缓存.
+func fetchSubscription(url string) (*subscription, error) {
+	l := fetchLock(url)
+	l.Lock()
+	defer l.Unlock()
+
+	cached, err := loadSubscriptionCache(url)
+	if err != nil {
+		cached = nil
+	}
+
+	sub, err := doFetchSubscription(url, cached)
+	if err == nil {
+		return sub, nil
+	}
+	if cached == nil {
+		return nil, err
+	}
+
+	cached.Stale = true
+	cached.Err = err
+	return cached, nil
+}
+
+func doFetchSubscription(url string, cached *subscription) (*subscription, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	rsp, err := subscriptionClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode == http.StatusNotModified && cached != nil {
+		cached.FetchedAt = time.Now()
+		if info := parseSubscriptionUserInfo(rsp.Header.Get("Subscription-Userinfo")); info != nil {
+			cached.UserInfo = info
+		}
+		cacheSubscription(cached, false)
+		return cached, nil
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", rsp.Status)
+	}
+
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// 只缓存能正常解析的订阅
+	if _, err := parseFromReader(bytes.NewReader(body)); err != nil {
+		return nil, err
+	}
+
+	sub := &subscription{
+		URL:          url,
+		ETag:         rsp.Header.Get("ETag"),
+		LastModified: rsp.Header.Get("Last-Modified"),
+		FetchedAt:    time.Now(),
+		UserInfo:     parseSubscriptionUserInfo(rsp.Header.Get("Subscription-Userinfo")),
+		Body:         body,
+	}
+	bodyChanged := cached == nil || !bytes.Equal(cached.Body, body)
+	cacheSubscription(sub, bodyChanged)
+	return sub, nil
+}
+
+// cacheSubscription 保存拉取到的订阅, 缓存目录不可写时仍然使用拉取到的订阅
+func cacheSubscription(sub *subscription, bodyChanged bool) {
+	if err := saveSubscriptionCache(sub, bodyChanged); err != nil {
+		logger.Warnw("save subscription cache failed", "url", sub.URL, "err", err)
+	}
+}
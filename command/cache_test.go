@@ -0,0 +1,106 @@
+package command
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newShare(vmesses ...*vmess) []byte {
+	var lines []string
+	for _, v := range vmesses {
+		lines = append(lines, "vmess://"+base64.StdEncoding.EncodeToString(v.Encode()))
+	}
+	data := strings.Join(lines, "\n")
+	return []byte(base64.StdEncoding.EncodeToString([]byte(data)))
+}
+
+func TestFetchSubscription(t *testing.T) {
+	setXDGDir(t, "XDG_CACHE_HOME", t.TempDir())
+
+	share := newShare(&vmess{Ps: "a", Add: "a.example.com", Port: 443})
+	down := false
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if down {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write(share)
+	}))
+	defer srv.Close()
+
+	sub, err := fetchSubscription(srv.URL)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if sub.Stale || sub.ETag != `"v1"` {
+		t.Fatalf("unexpected subscription: %+v\n", sub)
+	}
+
+	sub, err = fetchSubscription(srv.URL)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if sub.Stale || string(sub.Body) != string(share) {
+		t.Fatalf("not modified response should reuse cache: %+v\n", sub)
+	}
+
+	down = true
+	vmesses, sub, err := parseFromURL(srv.URL)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if !sub.Stale || len(vmesses) != 1 || vmesses[0].Ps != "a" {
+		t.Fatalf("expected stale cached copy, got: %+v\n", sub)
+	}
+	if requests != 3 {
+		t.Fatalf("requests: %d\n", requests)
+	}
+}
+
+func TestFetchSubscriptionUnwritableCache(t *testing.T) {
+	// 缓存目录的位置是一个文件, 无法创建缓存
+	file := filepath.Join(t.TempDir(), "cache")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	setXDGDir(t, "XDG_CACHE_HOME", file)
+
+	share := newShare(&vmess{Ps: "a", Add: "a.example.com", Port: 443})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(share)
+	}))
+	defer srv.Close()
+
+	vmesses, sub, err := parseFromURL(srv.URL)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if sub.Stale || len(vmesses) != 1 {
+		t.Fatalf("fresh subscription is not used: %+v\n", sub)
+	}
+}
+
+func TestParseSubscriptionUserInfo(t *testing.T) {
+	info := parseSubscriptionUserInfo("upload=100; download=800;total=1000; expire=1671815872; foo")
+	if info.Upload != 100 || info.Download != 800 || info.Total != 1000 || info.Expire.Unix() != 1671815872 {
+		t.Fatalf("info: %+v\n", info)
+	}
+	if info.UsedRatio() != 0.9 {
+		t.Fatalf("used ratio: %f\n", info.UsedRatio())
+	}
+	if parseSubscriptionUserInfo("") != nil {
+		t.Fatalf("empty header\n")
+	}
+}
@@ -0,0 +1,650 @@
+package command
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/adrg/xdg"
+	"github.com/jdxj/v2ray-bot/logger"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	configFileName = "config.yaml"
+	envPrefix      = "V2RAYBOT_"
+)
+
+var configCmd = &cobra.Command{
+	Use:                        "config",
+	Aliases:                    nil,
+	SuggestFor:                 nil,
+	Short:                      "inspect the config file and V2RAYBOT_* environment variables",
+	Long:                       "",
+	Example:                    "",
+	ValidArgs:                  nil,
+	ValidArgsFunction:          nil,
+	Args:                       nil,
+	ArgAliases:                 nil,
+	BashCompletionFunction:     "",
+	Deprecated:                 "",
+	Annotations:                nil,
+	Version:                    "",
+	PersistentPreRun:           nil,
+	PersistentPreRunE:          nil,
+	PreRun:                     nil,
+	PreRunE:                    nil,
+	Run:                        nil,
+	RunE:                       nil,
+	PostRun:                    nil,
+	PostRunE:                   nil,
+	PersistentPostRun:          nil,
+	PersistentPostRunE:         nil,
+	FParseErrWhitelist:         cobra.FParseErrWhitelist{},
+	CompletionOptions:          cobra.CompletionOptions{},
+	TraverseChildren:           false,
+	Hidden:                     false,
+	SilenceErrors:              false,
+	SilenceUsage:               false,
+	DisableFlagParsing:         false,
+	DisableAutoGenTag:          false,
+	DisableFlagsInUseLine:      false,
+	DisableSuggestions:         false,
+	SuggestionsMinimumDistance: 0,
+}
+
+var configShowCmd = &cobra.Command{
+	Use:        "show",
+	Aliases:    nil,
+	SuggestFor: nil,
+	Short:      "print the settings from the config file and environment variables",
+	Long: `example:
+  config show --redacted
+  config show --profile work
+
+values from environment variables override the config file, the selected
+profile is applied.`,
+	Example:                    "",
+	ValidArgs:                  nil,
+	ValidArgsFunction:          nil,
+	Args:                       cobra.NoArgs,
+	ArgAliases:                 nil,
+	BashCompletionFunction:     "",
+	Deprecated:                 "",
+	Annotations:                nil,
+	Version:                    "",
+	PersistentPreRun:           nil,
+	PersistentPreRunE:          nil,
+	PreRun:                     nil,
+	PreRunE:                    nil,
+	Run:                        configShowRun,
+	RunE:                       nil,
+	PostRun:                    nil,
+	PostRunE:                   nil,
+	PersistentPostRun:          nil,
+	PersistentPostRunE:         nil,
+	FParseErrWhitelist:         cobra.FParseErrWhitelist{},
+	CompletionOptions:          cobra.CompletionOptions{},
+	TraverseChildren:           false,
+	Hidden:                     false,
+	SilenceErrors:              false,
+	SilenceUsage:               false,
+	DisableFlagParsing:         false,
+	DisableAutoGenTag:          false,
+	DisableFlagsInUseLine:      false,
+	DisableSuggestions:         false,
+	SuggestionsMinimumDistance: 0,
+}
+
+var (
+	configFile     string
+	nameConfigFile = "config"
+
+	profile     string
+	nameProfile = "profile"
+
+	configRedacted     bool
+	nameConfigRedacted = "redacted"
+)
+
+func init() {
+	rootCmd.PersistentFlags().
+		StringVar(&configFile, nameConfigFile, "", "config file, default $XDG_CONFIG_HOME/v2ray-bot/config.yaml")
+
+	rootCmd.PersistentFlags().
+		StringVar(&profile, nameProfile, "", "profile of the config file to use, overrides profile in the file")
+
+	rootCmd.PersistentPreRunE = loadConfig
+
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configShowCmd)
+
+	configShowCmd.Flags().
+		BoolVar(&configRedacted, nameConfigRedacted, false, "hide tokens, passwords, uuids and subscription tokens")
+}
+
+// configList 是列表类型的参数, 也可以只写一个值
+type configList []string
+
+func (l *configList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = configList{value.Value}
+		return nil
+	}
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// configSettings 是配置文件中的参数, 键与命令行参数同名,
+// 值按命令行参数的格式解析, 只作用于有该参数的命令
+type configSettings struct {
+	Output        string     `yaml:"output,omitempty"`
+	Subscriptions configList `yaml:"subscriptions,omitempty"`
+
+	Log struct {
+		Level  string `yaml:"log-level,omitempty"`
+		Format string `yaml:"log-format,omitempty"`
+	} `yaml:"log,omitempty"`
+
+	// serve 的 /sub 没有指定过滤条件时使用
+	Filter struct {
+		Include  string     `yaml:"include,omitempty"`
+		Exclude  string     `yaml:"exclude,omitempty"`
+		Rename   configList `yaml:"rename,omitempty"`
+		KeepDead string     `yaml:"keep-dead,omitempty"`
+	} `yaml:"filter,omitempty"`
+
+	Ping struct {
+		ProbeURL      string `yaml:"probe-url,omitempty"`
+		Timeout       string `yaml:"timeout,omitempty"`
+		ProbeInterval string `yaml:"probe-interval,omitempty"`
+		CheckInterval string `yaml:"check-interval,omitempty"`
+		Balance       string `yaml:"balance,omitempty"`
+		History       string `yaml:"history,omitempty"`
+	} `yaml:"ping,omitempty"`
+
+	Inbound struct {
+		Listen      string `yaml:"listen,omitempty"`
+		InboundPort string `yaml:"inbound-port,omitempty"`
+		SocksPort   string `yaml:"socks-port,omitempty"`
+		SocksUDP    string `yaml:"socks-udp-addr,omitempty"`
+		TproxyPort  string `yaml:"tproxy-port,omitempty"`
+		Username    string `yaml:"username,omitempty"`
+		Password    string `yaml:"password,omitempty"`
+	} `yaml:"inbound,omitempty"`
+
+	Bot struct {
+		Token       string     `yaml:"token,omitempty"`
+		APIURL      string     `yaml:"api-url,omitempty"`
+		AllowChat   configList `yaml:"allow-chat,omitempty"`
+		PollTimeout string     `yaml:"poll-timeout,omitempty"`
+	} `yaml:"bot,omitempty"`
+
+	Serve struct {
+		Addr     string `yaml:"addr,omitempty"`
+		APIToken string `yaml:"api-token,omitempty"`
+		SubToken string `yaml:"sub-token,omitempty"`
+	} `yaml:"serve,omitempty"`
+
+	Daemon struct {
+		SubCron     string `yaml:"sub-cron,omitempty"`
+		PingCron    string `yaml:"ping-cron,omitempty"`
+		GeoCron     string `yaml:"geo-cron,omitempty"`
+		Jitter      string `yaml:"jitter,omitempty"`
+		MetricsAddr string `yaml:"metrics-addr,omitempty"`
+	} `yaml:"daemon,omitempty"`
+
+	Notify struct {
+		Telegram          configList `yaml:"telegram,omitempty"`
+		Webhook           configList `yaml:"webhook,omitempty"`
+		SMTP              string     `yaml:"smtp,omitempty"`
+		AlertAvailability string     `yaml:"alert-availability,omitempty"`
+		AlertExpire       string     `yaml:"alert-expire,omitempty"`
+		AlertTraffic      string     `yaml:"alert-traffic,omitempty"`
+		AlertBestMargin   string     `yaml:"alert-best-margin,omitempty"`
+	} `yaml:"notify,omitempty"`
+}
+
+// fileConfig 是配置文件, profiles 中的设置覆盖顶层的设置
+type fileConfig struct {
+	configSettings `yaml:",inline"`
+
+	Profile  string                     `yaml:"profile,omitempty"`
+	Profiles map[string]*configSettings `yaml:"profiles,omitempty"`
+}
+
+// configField 是一个参数在配置中的位置, value 为 *string 或 *configList,
+// array 表示列表的值可能含有逗号, 对应 StringArray 类型的参数
+type configField struct {
+	name   string
+	secret bool
+	array  bool
+	value  interface{}
+}
+
+func (s *configSettings) fields() []*configField {
+	return []*configField{
+		{name: nameOutput, value: &s.Output},
+		{name: nameDaemonSubs, value: &s.Subscriptions},
+		{name: nameLogLevel, value: &s.Log.Level},
+		{name: nameLogFormat, value: &s.Log.Format},
+
+		{name: nameSubInclude, value: &s.Filter.Include},
+		{name: nameSubExclude, value: &s.Filter.Exclude},
+		{name: nameSubRename, array: true, value: &s.Filter.Rename},
+		{name: nameSubKeepDead, value: &s.Filter.KeepDead},
+
+		{name: nameProbeURL, value: &s.Ping.ProbeURL},
+		{name: namePingTimeout, value: &s.Ping.Timeout},
+		{name: nameProbeInterval, value: &s.Ping.ProbeInterval},
+		{name: nameCheckInterval, value: &s.Ping.CheckInterval},
+		{name: nameBalanceStrategy, value: &s.Ping.Balance},
+		{name: nameSaveHistory, value: &s.Ping.History},
+
+		{name: nameListen, value: &s.Inbound.Listen},
+		{name: nameInboundPort, value: &s.Inbound.InboundPort},
+		{name: nameSocksPort, value: &s.Inbound.SocksPort},
+		{name: nameSocksUDPAddr, value: &s.Inbound.SocksUDP},
+		{name: nameTproxyPort, value: &s.Inbound.TproxyPort},
+		{name: nameProxyUsername, value: &s.Inbound.Username},
+		{name: nameProxyPassword, secret: true, value: &s.Inbound.Password},
+
+		{name: nameBotToken, secret: true, value: &s.Bot.Token},
+		{name: nameTelegramURL, value: &s.Bot.APIURL},
+		{name: nameAllowChats, value: &s.Bot.AllowChat},
+		{name: namePollTimeout, value: &s.Bot.PollTimeout},
+
+		{name: nameServeAddr, value: &s.Serve.Addr},
+		{name: nameAPIToken, secret: true, value: &s.Serve.APIToken},
+		{name: nameSubToken, secret: true, value: &s.Serve.SubToken},
+
+		{name: nameSubCron, value: &s.Daemon.SubCron},
+		{name: namePingCron, value: &s.Daemon.PingCron},
+		{name: nameGeoCron, value: &s.Daemon.GeoCron},
+		{name: nameJitter, value: &s.Daemon.Jitter},
+		{name: nameMetricsAddr, value: &s.Daemon.MetricsAddr},
+
+		{name: nameNotifyChats, value: &s.Notify.Telegram},
+		{name: nameNotifyWebhooks, value: &s.Notify.Webhook},
+		{name: nameNotifySMTP, value: &s.Notify.SMTP},
+		{name: nameAlertAvailability, value: &s.Notify.AlertAvailability},
+		{name: nameAlertExpire, value: &s.Notify.AlertExpire},
+		{name: nameAlertTraffic, value: &s.Notify.AlertTraffic},
+		{name: nameAlertBestMargin, value: &s.Notify.AlertBestMargin},
+	}
+}
+
+// flagValues 返回设置了的参数, 键为命令行参数名
+func (s *configSettings) flagValues() map[string][]string {
+	values := make(map[string][]string)
+	for _, f := range s.fields() {
+		switch v := f.value.(type) {
+		case *string:
+			if *v != "" {
+				values[f.name] = []string{*v}
+			}
+		case *configList:
+			if *v != nil {
+				values[f.name] = *v
+			}
+		}
+	}
+	return values
+}
+
+// setFlagValues 是 flagValues 的反向操作
+func (s *configSettings) setFlagValues(values map[string][]string) {
+	for _, f := range s.fields() {
+		v, ok := values[f.name]
+		if !ok {
+			continue
+		}
+		switch p := f.value.(type) {
+		case *string:
+			*p = strings.Join(v, ",")
+		case *configList:
+			*p = v
+		}
+	}
+}
+
+// redact 把密钥替换为 ***, 其他值中的订阅 token 和 uuid 也会被隐藏
+func (s *configSettings) redact() {
+	hide := func(f *configField, v string) string {
+		if f.secret {
+			return redacted
+		}
+		return redact(v)
+	}
+	for _, f := range s.fields() {
+		switch v := f.value.(type) {
+		case *string:
+			if *v != "" {
+				*v = hide(f, *v)
+			}
+		case *configList:
+			for i := range *v {
+				(*v)[i] = hide(f, (*v)[i])
+			}
+		}
+	}
+}
+
+// FlagValues 合并顶层和 name 指定的 profile, name 为空时使用文件中的 profile
+func (c *fileConfig) FlagValues(name string) (map[string][]string, error) {
+	values := c.configSettings.flagValues()
+	if name == "" {
+		name = c.Profile
+	}
+	if name == "" {
+		return values, nil
+	}
+
+	p, ok := c.Profiles[name]
+	if !ok {
+		names := make([]string, 0, len(c.Profiles))
+		for n := range c.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("profile %q not found, available: %v", name, names)
+	}
+	for k, v := range p.flagValues() {
+		values[k] = v
+	}
+	return values, nil
+}
+
+func readConfigFile(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(data, doc); err != nil {
+		return nil, fmt.Errorf("parse config %s err: %s", path, err)
+	}
+	if err := resolveFileKeys(doc, filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("config %s: %s", path, err)
+	}
+	if data, err = yaml.Marshal(doc); err != nil {
+		return nil, err
+	}
+
+	c := &fileConfig{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	// 拼错的键直接报错, 避免设置静默失效
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse config %s err: %s", path, err)
+	}
+	return c, nil
+}
+
+// resolveFileKeys 把 token_file: /run/secrets/token 替换为 token: <文件内容>,
+// 多行的文件作为列表, 相对路径基于配置文件所在的目录
+func resolveFileKeys(n *yaml.Node, dir string) error {
+	for _, child := range n.Content {
+		if err := resolveFileKeys(child, dir); err != nil {
+			return err
+		}
+	}
+	if n.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	keys := make(map[string]bool)
+	for i := 0; i < len(n.Content); i += 2 {
+		keys[n.Content[i].Value] = true
+	}
+	for i := 0; i < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		name := strings.TrimSuffix(strings.TrimSuffix(key.Value, "_file"), "-file")
+		if name == key.Value || value.Kind != yaml.ScalarNode {
+			continue
+		}
+		if keys[name] {
+			return fmt.Errorf("both %s and %s are set", name, key.Value)
+		}
+		path := value.Value
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		values, err := readSecretFile(path)
+		if err != nil {
+			return fmt.Errorf("read %s err: %s", key.Value, err)
+		}
+
+		key.Value = name
+		if len(values) == 1 {
+			*value = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: values[0]}
+			continue
+		}
+		*value = yaml.Node{Kind: yaml.SequenceNode}
+		for _, v := range values {
+			value.Content = append(value.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v})
+		}
+	}
+	return nil
+}
+
+// readSecretFile 读取文件中的值, 每行一个, 忽略空行
+func readSecretFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			values = append(values, line)
+		}
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return values, nil
+}
+
+// envName 返回参数对应的环境变量, 例如 api-token 对应 V2RAYBOT_API_TOKEN
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// 环境变量中列表参数的分隔符, StringArray 类型的值可能含有逗号, 只以换行分隔
+const (
+	listSepComma = ",\n"
+	listSepLine  = "\n"
+)
+
+// flagListSep 返回参数在环境变量中的分隔符, 不是列表时返回空
+func flagListSep(f *pflag.Flag) string {
+	if f.Value.Type() == "stringArray" {
+		return listSepLine
+	}
+	if _, ok := f.Value.(pflag.SliceValue); ok {
+		return listSepComma
+	}
+	return ""
+}
+
+// envFlagValues 读取 lists 中参数的环境变量, 值为列表参数的分隔符, 空表示不是列表.
+// 也可以通过 <NAME>_FILE 从文件中读取
+func envFlagValues(lists map[string]string) (map[string][]string, error) {
+	values := make(map[string][]string)
+	for name, sep := range lists {
+		key := envName(name)
+		var v []string
+		if raw, ok := os.LookupEnv(key); ok {
+			v = []string{raw}
+		} else if path, ok := os.LookupEnv(key + "_FILE"); ok {
+			lines, err := readSecretFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("read %s_FILE err: %s", key, err)
+			}
+			v = []string{strings.Join(lines, "\n")}
+		} else {
+			continue
+		}
+
+		if sep != "" {
+			v = strings.FieldsFunc(v[0], func(r rune) bool { return strings.ContainsRune(sep, r) })
+		}
+		values[name] = v
+	}
+	return values, nil
+}
+
+// findConfigFile 返回 --config 或 xdg 配置目录中的配置文件, 没有时返回空
+func findConfigFile() string {
+	if configFile != "" {
+		return configFile
+	}
+	path, err := xdg.SearchConfigFile(filepath.Join(appName, configFileName))
+	if err != nil {
+		// 默认位置没有配置文件
+		return ""
+	}
+	return path
+}
+
+// fileFlagValues 读取配置文件并选择 profile, 没有配置文件时返回空
+func fileFlagValues() (map[string][]string, error) {
+	path := findConfigFile()
+	if path == "" {
+		if profile != "" {
+			return nil, fmt.Errorf("--%s %s: no config file found", nameProfile, profile)
+		}
+		return map[string][]string{}, nil
+	}
+
+	c, err := readConfigFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("config file %s not found", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	values, err := c.FlagValues(profile)
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %s", path, err)
+	}
+	return values, nil
+}
+
+// applyFlagValues 把配置写入命令行没有设置的参数
+func applyFlagValues(flags *pflag.FlagSet, values map[string][]string, from string) error {
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		v, ok := values[f.Name]
+		if !ok || f.Changed || err != nil {
+			return
+		}
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			err = sv.Replace(v)
+		} else {
+			err = f.Value.Set(strings.Join(v, ","))
+		}
+		if err != nil {
+			err = fmt.Errorf("invalid %s in %s: %s", f.Name, from, err)
+		}
+	})
+	return err
+}
+
+// loadConfig 在执行每个命令前读取环境变量和配置文件并设置日志,
+// 优先级依次是命令行参数, 环境变量, 配置文件
+func loadConfig(cmd *cobra.Command, args []string) error {
+	err := applyConfig(cmd.Flags())
+	if err == nil {
+		err = logger.Init(logLevel, logFormat)
+	}
+	if err != nil {
+		// 配置错误时不需要输出用法
+		cmd.SilenceUsage = true
+	}
+	return err
+}
+
+func applyConfig(flags *pflag.FlagSet) error {
+	lists := make(map[string]string)
+	flags.VisitAll(func(f *pflag.Flag) {
+		lists[f.Name] = flagListSep(f)
+	})
+	env, err := envFlagValues(lists)
+	if err != nil {
+		return err
+	}
+	// 先应用环境变量, --config 和 --profile 也可以来自环境变量
+	if err := applyFlagValues(flags, env, "environment"); err != nil {
+		return err
+	}
+
+	values, err := fileFlagValues()
+	if err != nil {
+		return err
+	}
+	for name := range env {
+		delete(values, name)
+	}
+	return applyFlagValues(flags, values, "config")
+}
+
+func configShowRun(cmd *cobra.Command, args []string) {
+	settings := &configSettings{}
+	lists := make(map[string]string)
+	for _, f := range settings.fields() {
+		lists[f.name] = ""
+		if _, ok := f.value.(*configList); ok {
+			lists[f.name] = listSepComma
+		}
+		if f.array {
+			lists[f.name] = listSepLine
+		}
+	}
+	env, err := envFlagValues(lists)
+	if err != nil {
+		cmd.PrintErrf("%s\n", err)
+		return
+	}
+	values, err := fileFlagValues()
+	if err != nil {
+		cmd.PrintErrf("%s\n", err)
+		return
+	}
+	for name, v := range env {
+		values[name] = v
+	}
+
+	settings.setFlagValues(values)
+	if configRedacted {
+		settings.redact()
+	}
+	data, err := yaml.Marshal(settings)
+	if err != nil {
+		cmd.PrintErrf("marshal config err: %s\n", err)
+		return
+	}
+
+	path := findConfigFile()
+	if path == "" {
+		path = "none"
+	}
+	cmd.Printf("# config file: %s\n", path)
+	if profile != "" {
+		cmd.Printf("# profile: %s\n", profile)
+	}
+	cmd.Printf("%s", data)
+}
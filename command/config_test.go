@@ -0,0 +1,173 @@
+package command
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+func TestApplyConfig(t *testing.T) {
+	dir := t.TempDir()
+	setXDGDir(t, "XDG_CONFIG_HOME", dir)
+
+	data := []byte(`
+profile: home
+subscriptions:
+  - https://a.example.com/sub
+  - https://b.example.com/sub
+ping:
+  timeout: 5s
+inbound:
+  inbound-port: 7000
+bot:
+  allow-chat: [1, 2]
+profiles:
+  home:
+    inbound:
+      inbound-port: 7001
+  work:
+    ping:
+      timeout: 3s
+`)
+	if err := os.MkdirAll(filepath.Join(dir, appName), 0755); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, appName, configFileName), data, 0644); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	var (
+		subs    []string
+		timeout time.Duration
+		port    uint32
+		chats   []int64
+		from    string
+	)
+	newFlags := func(args ...string) *pflag.FlagSet {
+		flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		flags.StringSliceVar(&subs, nameDaemonSubs, nil, "")
+		flags.DurationVar(&timeout, namePingTimeout, 10*time.Second, "")
+		flags.Uint32Var(&port, nameInboundPort, 7891, "")
+		flags.Int64SliceVar(&chats, nameAllowChats, nil, "")
+		flags.StringVar(&from, nameFromURL, "", "")
+		if err := flags.Parse(args); err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		return flags
+	}
+
+	if err := applyConfig(newFlags()); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if len(subs) != 2 || timeout != 5*time.Second || port != 7001 || !reflect.DeepEqual(chats, []int64{1, 2}) {
+		t.Fatalf("subs: %v, timeout: %s, port: %d, chats: %v\n", subs, timeout, port, chats)
+	}
+	// subscriptions 不会设置 --from-url, 否则 parse --from-file 和 diff old new 无法使用
+	if from != "" {
+		t.Fatalf("from-url: %s, want empty\n", from)
+	}
+
+	// 命令行参数优先于配置文件
+	profile = "work"
+	defer func() { profile = "" }()
+	if err := applyConfig(newFlags("--timeout", "1s")); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if timeout != time.Second || port != 7000 {
+		t.Fatalf("timeout: %s, port: %d\n", timeout, port)
+	}
+
+	profile = "none"
+	if err := applyConfig(newFlags()); err == nil {
+		t.Fatalf("want err for unknown profile\n")
+	}
+	profile = ""
+
+	for _, bad := range []string{"ping:\n  timeout: soon\n", "ping:\n  timout: 1s\n"} {
+		configFile = filepath.Join(dir, "bad.yaml")
+		if err := os.WriteFile(configFile, []byte(bad), 0644); err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		if err := applyConfig(newFlags()); err == nil {
+			t.Fatalf("want err for %q\n", bad)
+		}
+	}
+	configFile = filepath.Join(dir, "missing.yaml")
+	defer func() { configFile = "" }()
+	if err := applyConfig(newFlags()); err == nil {
+		t.Fatalf("want err for missing config\n")
+	}
+}
+
+func TestConfigEnv(t *testing.T) {
+	dir := t.TempDir()
+	setXDGDir(t, "XDG_CONFIG_HOME", dir)
+
+	secret := filepath.Join(dir, "token")
+	if err := os.WriteFile(secret, []byte("123456:secret-bot-token\n"), 0600); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	subs := filepath.Join(dir, "subs")
+	if err := os.WriteFile(subs, []byte("https://a.example.com/sub?token=a\nhttps://b.example.com/sub?token=b\n"), 0600); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	configFile = filepath.Join(dir, "config.yaml")
+	defer func() { configFile = "" }()
+	data := []byte(`
+subscriptions_file: subs
+bot:
+  token_file: ` + secret + `
+ping:
+  timeout: 5s
+`)
+	if err := os.WriteFile(configFile, data, 0644); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	t.Setenv("V2RAYBOT_TIMEOUT", "3s")
+	t.Setenv("V2RAYBOT_ALLOW_CHAT", "1,2")
+	// rename 的规则可能含有逗号, 只以换行分隔
+	t.Setenv("V2RAYBOT_RENAME", "^(HK|JP),=>$1 \n^test=>")
+
+	var (
+		token   string
+		urls    []string
+		timeout time.Duration
+		chats   []int64
+		renames []string
+	)
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.StringVar(&token, nameBotToken, "", "")
+	flags.StringSliceVar(&urls, nameDaemonSubs, nil, "")
+	flags.DurationVar(&timeout, namePingTimeout, 10*time.Second, "")
+	flags.Int64SliceVar(&chats, nameAllowChats, nil, "")
+	flags.StringArrayVar(&renames, nameSubRename, nil, "")
+	if err := applyConfig(flags); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if token != "123456:secret-bot-token" || len(urls) != 2 || timeout != 3*time.Second || len(chats) != 2 {
+		t.Fatalf("token: %s, urls: %v, timeout: %s, chats: %v\n", token, urls, timeout, chats)
+	}
+	if want := []string{"^(HK|JP),=>$1 ", "^test=>"}; !reflect.DeepEqual(renames, want) {
+		t.Fatalf("renames: %q, want: %q\n", renames, want)
+	}
+
+	out := &bytes.Buffer{}
+	configShowCmd.SetOut(out)
+	configRedacted = true
+	defer func() { configRedacted = false }()
+	configShowRun(configShowCmd, nil)
+	for _, secret := range []string{"secret-bot-token", "token=a", "token=b"} {
+		if strings.Contains(out.String(), secret) {
+			t.Fatalf("%s not redacted:\n%s\n", secret, out)
+		}
+	}
+	if !strings.Contains(out.String(), "timeout: 3s") {
+		t.Fatalf("env not applied:\n%s\n", out)
+	}
+}
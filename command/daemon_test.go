@@ -0,0 +1,155 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jdxj/v2ray-bot/logger"
+)
+
+func TestDaemonJobSkipOverlap(t *testing.T) {
+	var runs int32
+	release := make(chan struct{})
+	buf := &bytes.Buffer{}
+	logger.SetOutput(buf)
+	defer logger.SetOutput(os.Stderr)
+	job := &daemonJob{
+		ctx:  context.Background(),
+		name: "test",
+		run: func() error {
+			atomic.AddInt32(&runs, 1)
+			<-release
+			return nil
+		},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		job.RunNow()
+		close(done)
+	}()
+	for atomic.LoadInt32(&runs) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// 上一次还没结束, 直接跳过
+	job.Run()
+	close(release)
+	<-done
+
+	if runs != 1 {
+		t.Fatalf("runs: %d\n", runs)
+	}
+	if out := buf.String(); !strings.Contains(out, "job is still running") {
+		t.Fatalf("skip is not logged: %s\n", out)
+	}
+
+	// 退出后不再执行
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	job.ctx = ctx
+	job.RunNow()
+	if runs != 1 {
+		t.Fatalf("runs after cancel: %d\n", runs)
+	}
+}
+
+func TestDaemonRefreshSubscriptions(t *testing.T) {
+	setXDGDir(t, "XDG_CACHE_HOME", t.TempDir())
+	setXDGDir(t, "XDG_DATA_HOME", t.TempDir())
+
+	share := newShare(
+		&vmess{Ps: "a", Id: "2015cdb0-4f09-4796-7ec6-91b2e5dc2923", Add: "a.example.com", Port: 443},
+		&vmess{Ps: "bad", Id: "not-a-uuid", Add: "b.example.com", Port: 443},
+	)
+	sub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(share)
+	}))
+	defer sub.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer down.Close()
+
+	// bot 中添加的订阅也会刷新
+	store, err := loadBotStore()
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if _, err := store.Add(down.URL); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	state, err := loadDaemonState()
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	d := &daemonRunner{state: state, subs: []string{sub.URL}}
+	if err := d.RefreshSubscriptions(); err == nil {
+		t.Fatalf("failed subscription is not reported\n")
+	}
+
+	state, err = loadDaemonState()
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if len(state.Nodes) != 1 || state.Nodes[0].Ps != "a" {
+		t.Fatalf("nodes: %+v\n", state.Nodes)
+	}
+	if st := state.Subscriptions[sub.URL]; st == nil || st.Nodes != 1 || st.Error != "" {
+		t.Fatalf("subscription state: %+v\n", st)
+	}
+	if st := state.Subscriptions[down.URL]; st == nil || st.Error == "" {
+		t.Fatalf("subscription state: %+v\n", st)
+	}
+	if info, err := os.Stat(state.path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("state file: %v, err: %v\n", info, err)
+	}
+}
+
+func TestDaemonStateConcurrentUpdate(t *testing.T) {
+	setXDGDir(t, "XDG_DATA_HOME", t.TempDir())
+
+	// daemon 和 serve 是不同的进程, 各自持有一个 daemonState
+	states := make([]*daemonState, 2)
+	for i := range states {
+		state, err := loadDaemonState()
+		if err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		states[i] = state
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := states[i%2].update(func() {
+				// 放大读取和写入之间的间隔
+				time.Sleep(time.Millisecond)
+				states[i%2].Subscriptions[fmt.Sprintf("https://sub.example.com/%d", i)] = &subscriptionState{Nodes: i}
+			})
+			if err != nil {
+				t.Errorf("%s\n", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	state, err := loadDaemonState()
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if len(state.Subscriptions) != 20 {
+		t.Fatalf("%d subscriptions, want 20\n", len(state.Subscriptions))
+	}
+}
@@ -0,0 +1,251 @@
+package command
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var diff = &cobra.Command{
+	Use:        "diff",
+	Aliases:    nil,
+	SuggestFor: nil,
+	Short:      "show nodes added, removed or changed",
+	Long: `example:
+  diff old.json new.json
+  diff --from-url https://example.com/sub`,
+	Example:                    "",
+	ValidArgs:                  nil,
+	ValidArgsFunction:          nil,
+	Args:                       nil,
+	ArgAliases:                 nil,
+	BashCompletionFunction:     "",
+	Deprecated:                 "",
+	Annotations:                nil,
+	Version:                    "",
+	PersistentPreRun:           nil,
+	PersistentPreRunE:          nil,
+	PreRun:                     nil,
+	PreRunE:                    nil,
+	Run:                        diffRun,
+	RunE:                       nil,
+	PostRun:                    nil,
+	PostRunE:                   nil,
+	PersistentPostRun:          nil,
+	PersistentPostRunE:         nil,
+	FParseErrWhitelist:         cobra.FParseErrWhitelist{},
+	CompletionOptions:          cobra.CompletionOptions{},
+	TraverseChildren:           false,
+	Hidden:                     false,
+	SilenceErrors:              false,
+	SilenceUsage:               false,
+	DisableFlagParsing:         false,
+	DisableAutoGenTag:          false,
+	DisableFlagsInUseLine:      false,
+	DisableSuggestions:         false,
+	SuggestionsMinimumDistance: 0,
+}
+
+var (
+	diffURL     string
+	nameDiffURL = "from-url"
+
+	diffJSON     bool
+	nameDiffJSON = "json"
+)
+
+func init() {
+	rootCmd.AddCommand(diff)
+
+	diff.Flags().
+		StringVar(&diffURL, nameDiffURL, "", "compare the cached subscription with a fresh fetch")
+
+	diff.Flags().
+		BoolVar(&diffJSON, nameDiffJSON, false, "print the result as json")
+}
+
+func diffRun(cmd *cobra.Command, args []string) {
+	var (
+		oldVmesses, newVmesses []*vmess
+		err                    error
+	)
+	switch {
+	case diffURL != "":
+		oldVmesses, newVmesses, err = diffFromURL(diffURL)
+	case len(args) == 2:
+		oldVmesses, newVmesses, err = diffFromFile(args[0], args[1])
+	default:
+		cmd.PrintErrln("diff requires two files or --from-url")
+		return
+	}
+	if err != nil {
+		cmd.PrintErrf("load nodes err: %s\n", err)
+		return
+	}
+
+	result := diffVmess(oldVmesses, newVmesses)
+	if diffJSON {
+		err = json.NewEncoder(cmd.OutOrStdout()).Encode(result)
+		if err != nil {
+			cmd.PrintErrf("encode diff err: %s\n", err)
+		}
+		return
+	}
+	printDiff(cmd, result)
+}
+
+func diffFromFile(oldFile, newFile string) ([]*vmess, []*vmess, error) {
+	oldVmesses, err := readVmessFile(oldFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	newVmesses, err := readVmessFile(newFile)
+	return oldVmesses, newVmesses, err
+}
+
+func diffFromURL(url string) ([]*vmess, []*vmess, error) {
+	cached, err := loadSubscriptionCache(url)
+	if err != nil {
+		return nil, nil, fmt.Errorf("no cached subscription: %s", err)
+	}
+	oldVmesses, err := parseFromReader(bytes.NewReader(cached.Body))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newVmesses, sub, err := parseFromURL(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	// 更新失败时得到的是缓存, 和缓存比较没有意义
+	if sub.Stale {
+		return nil, nil, fmt.Errorf("fetch subscription err: %s, nothing to compare", sub.Err)
+	}
+	return oldVmesses, newVmesses, nil
+}
+
+type fieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+type modifiedNode struct {
+	Name    string         `json:"name"`
+	Changes []*fieldChange `json:"changes"`
+}
+
+type nodeDiff struct {
+	Added    []*vmess        `json:"added"`
+	Removed  []*vmess        `json:"removed"`
+	Modified []*modifiedNode `json:"modified"`
+}
+
+func (d *nodeDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+// nodeKey 用备注识别节点, 没有备注时使用地址和端口
+func nodeKey(v *vmess) string {
+	if v.Ps != "" {
+		return v.Ps
+	}
+	return fmt.Sprintf("%s:%d", v.Add, v.Port)
+}
+
+// nodeID 根据连接参数生成节点的标识, 不受备注和顺序的影响
+func nodeID(v *vmess) string {
+	fields := []string{v.Add, strconv.Itoa(int(v.Port)), v.Id, v.Net, v.Type, v.Host, v.Path, v.Tls}
+	sum := sha256.Sum256([]byte(strings.Join(fields, "|")))
+	return hex.EncodeToString(sum[:6])
+}
+
+func indexVmess(vmesses []*vmess) ([]string, map[string]*vmess) {
+	var keys []string
+	index := make(map[string]*vmess, len(vmesses))
+	for _, v := range vmesses {
+		key := nodeKey(v)
+		for i := 2; index[key] != nil; i++ {
+			key = fmt.Sprintf("%s#%d", nodeKey(v), i)
+		}
+		keys = append(keys, key)
+		index[key] = v
+	}
+	return keys, index
+}
+
+func diffVmess(oldVmesses, newVmesses []*vmess) *nodeDiff {
+	oldKeys, oldIndex := indexVmess(oldVmesses)
+	newKeys, newIndex := indexVmess(newVmesses)
+
+	result := &nodeDiff{}
+	for _, key := range oldKeys {
+		if newIndex[key] == nil {
+			result.Removed = append(result.Removed, oldIndex[key])
+		}
+	}
+	for _, key := range newKeys {
+		o, n := oldIndex[key], newIndex[key]
+		if o == nil {
+			result.Added = append(result.Added, n)
+			continue
+		}
+		if changes := diffFields(o, n); len(changes) > 0 {
+			result.Modified = append(result.Modified, &modifiedNode{
+				Name:    key,
+				Changes: changes,
+			})
+		}
+	}
+	return result
+}
+
+// diffFields 比较分享链接中的字段, 解析地址得到的 ips 和 country 不参与比较
+func diffFields(o, n *vmess) []*fieldChange {
+	var changes []*fieldChange
+	ov, nv := reflect.ValueOf(o).Elem(), reflect.ValueOf(n).Elem()
+	for i := 0; i < ov.NumField(); i++ {
+		field := strings.Split(ov.Type().Field(i).Tag.Get("json"), ",")[0]
+		if field == "" || field == "-" {
+			continue
+		}
+		oldValue := fmt.Sprint(ov.Field(i).Interface())
+		newValue := fmt.Sprint(nv.Field(i).Interface())
+		if oldValue != newValue {
+			changes = append(changes, &fieldChange{
+				Field: field,
+				Old:   oldValue,
+				New:   newValue,
+			})
+		}
+	}
+	return changes
+}
+
+func printDiff(cmd *cobra.Command, d *nodeDiff) {
+	if d.Empty() {
+		cmd.Println("no changes")
+		return
+	}
+	// 修改的字段中可能有 uuid
+	w := redactedOut(cmd)
+	for _, v := range d.Added {
+		_, _ = fmt.Fprintf(w, "+ %s (%s:%d)\n", v.Ps, v.Add, v.Port)
+	}
+	for _, v := range d.Removed {
+		_, _ = fmt.Fprintf(w, "- %s (%s:%d)\n", v.Ps, v.Add, v.Port)
+	}
+	for _, m := range d.Modified {
+		_, _ = fmt.Fprintf(w, "~ %s\n", m.Name)
+		for _, c := range m.Changes {
+			_, _ = fmt.Fprintf(w, "    %s: %s -> %s\n", c.Field, c.Old, c.New)
+		}
+	}
+}
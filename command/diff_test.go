@@ -0,0 +1,68 @@
+package command
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestDiffVmess(t *testing.T) {
+	oldVmesses := []*vmess{
+		{Ps: "hk", Add: "hk.example.com", Port: 443, Id: "a"},
+		{Ps: "jp", Add: "jp.example.com", Port: 443, Id: "b"},
+	}
+	newVmesses := []*vmess{
+		{Ps: "hk", Add: "hk2.example.com", Port: 443, Id: "c"},
+		{Ps: "us", Add: "us.example.com", Port: 443, Id: "d"},
+	}
+
+	result := diffVmess(oldVmesses, newVmesses)
+	if len(result.Added) != 1 || result.Added[0].Ps != "us" {
+		t.Fatalf("added: %+v\n", result.Added)
+	}
+	if len(result.Removed) != 1 || result.Removed[0].Ps != "jp" {
+		t.Fatalf("removed: %+v\n", result.Removed)
+	}
+	if len(result.Modified) != 1 || len(result.Modified[0].Changes) != 2 {
+		t.Fatalf("modified: %+v\n", result.Modified)
+	}
+	for _, c := range result.Modified[0].Changes {
+		t.Logf("%+v", c)
+	}
+
+	if !diffVmess(oldVmesses, oldVmesses).Empty() {
+		t.Fatalf("same nodes should have no diff\n")
+	}
+
+	resolved := []*vmess{
+		{Ps: "hk", Add: "hk.example.com", Port: 443, Id: "a", IPs: []string{"1.1.1.1"}, Country: "hk"},
+		{Ps: "jp", Add: "jp.example.com", Port: 443, Id: "b", IPs: []string{"2.2.2.2"}, Country: "jp"},
+	}
+	if d := diffVmess(oldVmesses, resolved); !d.Empty() {
+		t.Fatalf("resolved nodes should have no diff: %+v\n", d.Modified)
+	}
+}
+
+func TestPrintDiff(t *testing.T) {
+	const (
+		oldID = "0c8d2f4e-1b3a-4c5d-8e9f-0a1b2c3d4e5f"
+		newID = "7f6e5d4c-3b2a-4190-8f7e-6d5c4b3a2910"
+	)
+	d := diffVmess(
+		[]*vmess{{Ps: "hk", Add: "hk.example.com", Port: 443, Id: oldID}},
+		[]*vmess{{Ps: "hk", Add: "hk.example.com", Port: 443, Id: newID}},
+	)
+	buf := &bytes.Buffer{}
+	cmd := &cobra.Command{}
+	cmd.SetOut(buf)
+	printDiff(cmd, d)
+	out := buf.String()
+	if !strings.Contains(out, "~ hk") {
+		t.Fatalf("missing modified node in:\n%s\n", out)
+	}
+	if strings.Contains(out, oldID) || strings.Contains(out, newID) {
+		t.Fatalf("uuid is not redacted:\n%s\n", out)
+	}
+}
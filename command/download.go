@@ -1,19 +1,22 @@
 package command
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 
+	"github.com/jdxj/v2ray-bot/logger"
 	"github.com/spf13/cobra"
-)
-
-const (
-	geoIpURL   = "https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/geoip.dat"
-	geoSiteURL = "https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/geosite.dat"
+	"github.com/v2fly/v2ray-core/v5/app/router"
 )
 
 var download = &cobra.Command{
@@ -21,9 +24,11 @@ var download = &cobra.Command{
 	Aliases:    nil,
 	SuggestFor: nil,
 	Short:      "",
-	Long: fmt.Sprintf(`example:
-  download: %s
-  download: %s`, geoIpURL, geoSiteURL),
+	Long: `example:
+  download https://example.com/geoip.dat
+  download --all
+  download --all --source v2fly
+  download --all --sources sources.json --source mirror`,
 	Example:                    "",
 	ValidArgs:                  nil,
 	ValidArgsFunction:          nil,
@@ -59,50 +64,437 @@ var download = &cobra.Command{
 var (
 	all     bool
 	nameAll = "all"
+
+	verify     bool
+	nameVerify = "verify"
+
+	parallel     int
+	nameParallel = "parallel"
+
+	via     string
+	nameVia = "via"
+
+	source     string
+	nameSource = "source"
+
+	sourcesFile     string
+	nameSourcesFile = "sources"
+
+	force     bool
+	nameForce = "force"
 )
 
 func init() {
 	rootCmd.AddCommand(download)
 
 	download.Flags().
-		BoolVar(&all, nameAll, false, "download the resources listed in the example")
+		BoolVar(&all, nameAll, false, "download geoip.dat and geosite.dat from --source when a newer release exists")
+
+	download.Flags().
+		StringVar(&source, nameSource, "loyalsoldier", "geo data source used by --all: loyalsoldier, v2fly or one from --sources")
+
+	download.Flags().
+		StringVar(&sourcesFile, nameSourcesFile, "", "json file with custom geo data sources")
+
+	download.Flags().
+		BoolVar(&force, nameForce, false, "download even if the installed release is the latest")
+
+	download.Flags().
+		BoolVar(&verify, nameVerify, true, "verify the .sha256sum published alongside each file, required for geo data sources that publish one")
+
+	download.Flags().
+		IntVar(&parallel, nameParallel, 2, "max number of files downloaded at the same time")
+
+	download.Flags().
+		StringVar(&via, nameVia, "env", "how to reach the network: direct, env (proxy from environment) or node=<name>")
+
+	download.Flags().
+		StringVar(&vmessFile, nameVmessFile, "vmess.txt", "parsed vmess config (parse cmd), used by --via node")
+}
+
+type downloadTask struct {
+	url      string
+	filePath string
+	// 非空时表示来自 geo 数据源, 下载成功后记录到 manifest
+	release *geoRelease
+}
+
+// requireChecksum 返回是否必须校验, 其他地址没有发布 .sha256sum 时跳过校验
+func (t *downloadTask) requireChecksum() bool {
+	return t.release != nil && t.release.Asset.Checksum
 }
 
 func downloadRun(cmd *cobra.Command, args []string) {
-	if all {
-		args = append(args, geoIpURL, geoSiteURL)
-	}
-	if len(args) < 1 {
+	if len(args) < 1 && !all {
 		cmd.PrintErrln("download requires at least one argument")
 		return
 	}
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	c, closeClient, err := getDownloadClient(via)
+	if err != nil {
+		cmd.PrintErrf("get http client err: %s\n", err)
+		return
+	}
+	defer closeClient()
+
+	manifest, err := loadGeoManifest(output)
+	if err != nil {
+		cmd.PrintErrf("load geo manifest err: %s\n", err)
+		return
+	}
 
-	c := getHttpClient()
+	var tasks []*downloadTask
+	if all {
+		tasks, _, err = getGeoTasks(c, manifest, source)
+		if err != nil {
+			cmd.PrintErrf("get geo data release err: %s\n", err)
+			return
+		}
+	}
 	for _, dl := range args {
-		if err := downloadFromURL(c, dl); err != nil {
-			cmd.PrintErrf("download %s err: %s\n", dl, err)
+		tasks = append(tasks, &downloadTask{
+			url:      dl,
+			filePath: filepath.Join(output, path.Base(dl)),
+		})
+	}
+
+	runDownloadTasks(c, manifest, tasks, parallel, newProgress(cmd.ErrOrStderr()))
+}
+
+// runDownloadTasks 最多同时下载 parallel 个文件, 返回失败任务的错误
+func runDownloadTasks(c *http.Client, manifest *geoManifest, tasks []*downloadTask, parallel int, p *progress) []error {
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+	sem := make(chan struct{}, parallel)
+	wg := sync.WaitGroup{}
+	for _, task := range tasks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(task *downloadTask) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			err := downloadToFile(c, task.url, task.filePath, task.requireChecksum(), p)
+			if err != nil {
+				err = fmt.Errorf("download %s err: %s", task.url, err)
+			} else if task.release != nil {
+				if err = manifest.Installed(task.release); err != nil {
+					err = fmt.Errorf("update geo manifest err: %s", err)
+				}
+			}
+			if err == nil {
+				return
+			}
+
+			p.Logf("%s\n", err)
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}(task)
+	}
+	wg.Wait()
+	return errs
+}
+
+// getGeoTasks 返回数据源中需要下载的文件, upToDate 是已经是最新版本而跳过的文件
+func getGeoTasks(c *http.Client, manifest *geoManifest, name string) (tasks []*downloadTask, upToDate []*geoRelease, err error) {
+	sources, err := loadGeoSources(sourcesFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := findGeoSource(sources, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	releases, err := resolveGeoReleases(c, s)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, r := range releases {
+		if !force && manifest.UpToDate(r) {
+			logger.Infow("geo data is up to date", "file", r.Asset.File, "source", r.Source, "tag", r.Tag)
+			upToDate = append(upToDate, r)
 			continue
 		}
+		tasks = append(tasks, &downloadTask{
+			url:      r.URL,
+			filePath: filepath.Join(output, r.Asset.File),
+			release:  r,
+		})
+	}
+	return tasks, upToDate, nil
+}
+
+// getDownloadClient 根据 --via 返回下载使用的 http client,
+// node 模式会启动一个只有该节点出站的 v2ray 实例, 直接经由实例拨号, 不监听端口,
+// 下载结束后需要调用 close
+func getDownloadClient(via string) (*http.Client, func(), error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	switch {
+	case via == "direct":
+		transport.Proxy = nil
+		return &http.Client{Transport: transport}, func() {}, nil
+	case via == "env":
+		transport.Proxy = http.ProxyFromEnvironment
+		return &http.Client{Transport: transport}, func() {}, nil
+	case strings.HasPrefix(via, "node="):
+	default:
+		return nil, nil, fmt.Errorf("unknown via: %s", via)
+	}
+
+	name := strings.TrimPrefix(via, "node=")
+	vmesses, err := getVmessFromFile()
+	if err != nil {
+		return nil, nil, err
+	}
+	var node *vmess
+	for _, v := range vmesses {
+		if nodeKey(v) == name {
+			node = v
+			break
+		}
+	}
+	if node == nil {
+		return nil, nil, fmt.Errorf("node %s not found in %s", name, vmessFile)
+	}
+	if problems := append(validateVmess(node), outboundProblems(node)...); len(problems) > 0 {
+		return nil, nil, fmt.Errorf("invalid node %s: %s", name, strings.Join(problems, ", "))
+	}
+
+	cfg := newV2rayConfig(nil, &router.Config{})
+	cfg.Outbound = append(cfg.Outbound, newOutboundConfig(routingTag, node))
+	ins, err := startV2ray(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	// 下载大文件时不限制总时间
+	return newTaggedClient(ins, routingTag, 0), func() { _ = ins.Close() }, nil
+}
+
+// downloadFromURL 先下载到 .part 文件, 校验通过后再原子地替换目标文件,
+// 旧文件保留为 .bak. 中断后再次下载时会通过 Range 和 If-Range 请求续传 .part 文件.
+func downloadFromURL(client *http.Client, dl string, p *progress) error {
+	return downloadToFile(client, dl, filepath.Join(output, path.Base(dl)), false, p)
+}
+
+func downloadToFile(client *http.Client, dl, filePath string, requireChecksum bool, p *progress) error {
+	partPath := filePath + ".part"
+
+	var checksum string
+	if verify {
+		var err error
+		checksum, err = fetchChecksum(client, dl)
+		switch {
+		case err != nil && !requireChecksum:
+			// 任意地址不一定发布了 .sha256sum, 获取失败时不影响下载
+			logger.Warnw("fetch checksum failed, skip verification", "url", dl, "err", err)
+		case err != nil:
+			return fmt.Errorf("fetch checksum err: %s", err)
+		}
+	}
+
+	if err := downloadPart(client, dl, filePath, p); err != nil {
+		return err
+	}
+
+	sum, err := fileChecksum(partPath)
+	if err != nil {
+		return err
+	}
+	if checksum != "" && sum != checksum {
+		removePart(partPath)
+		return fmt.Errorf("checksum mismatch: want %s, got %s", checksum, sum)
 	}
+	if err := backupFile(filePath); err != nil {
+		return fmt.Errorf("backup %s err: %s", filePath, err)
+	}
+	if err := os.Rename(partPath, filePath); err != nil {
+		return err
+	}
+	removePart(partPath)
+	return nil
 }
 
-func downloadFromURL(client *http.Client, dl string) error {
-	filePath := filepath.Join(output, path.Base(dl))
-	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR, 0644)
+// downloadPart 下载到 .part 文件, .part.validator 保存开始下载时的 ETag 或 Last-Modified,
+// 续传时通过 If-Range 确认文件没有变化, 否则从头下载
+func downloadPart(client *http.Client, dl, filePath string, p *progress) error {
+	partPath := filePath + ".part"
+	validatorPath := partPath + ".validator"
+
+	var offset int64
+	validator, _ := os.ReadFile(validatorPath)
+	if info, err := os.Stat(partPath); err == nil && len(validator) > 0 {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, dl, nil)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		_ = f.Sync()
-		_ = f.Close()
-	}()
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", string(validator))
+	}
 
-	rsp, err := client.Get(dl)
+	rsp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer rsp.Body.Close()
 
-	_, err = io.Copy(f, rsp.Body)
-	return err
+	switch rsp.StatusCode {
+	case http.StatusOK:
+		offset = 0
+	case http.StatusPartialContent:
+		if offset > 0 && contentRangeStart(rsp.Header.Get("Content-Range")) == offset {
+			break
+		}
+		fallthrough
+	case http.StatusRequestedRangeNotSatisfiable:
+		if offset == 0 {
+			return fmt.Errorf("unexpected status: %s", rsp.Status)
+		}
+		// .part 与服务端的文件对不上, 从头下载
+		_ = rsp.Body.Close()
+		removePart(partPath)
+		return downloadPart(client, dl, filePath, p)
+	default:
+		return fmt.Errorf("unexpected status: %s", rsp.Status)
+	}
+
+	flag := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if offset == 0 {
+		flag = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if err := savePartValidator(validatorPath, rsp.Header); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(partPath, flag, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	total := int64(-1)
+	if rsp.ContentLength >= 0 {
+		total = offset + rsp.ContentLength
+	}
+	task := p.Task(filepath.Base(filePath), total, offset)
+	defer task.Finish()
+
+	if _, err := io.Copy(io.MultiWriter(f, task), rsp.Body); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// savePartValidator 保存 If-Range 使用的强 ETag 或 Last-Modified, 都没有时不能续传
+func savePartValidator(validatorPath string, header http.Header) error {
+	validator := header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = header.Get("Last-Modified")
+	}
+	if validator == "" {
+		err := os.Remove(validatorPath)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return os.WriteFile(validatorPath, []byte(validator), 0644)
+}
+
+// contentRangeStart 返回 Content-Range 的起始位置, 格式错误时返回 -1
+func contentRangeStart(contentRange string) int64 {
+	var start int64
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-", &start); err != nil {
+		return -1
+	}
+	return start
+}
+
+func removePart(partPath string) {
+	_ = os.Remove(partPath)
+	_ = os.Remove(partPath + ".validator")
+}
+
+func fileChecksum(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+var errNoChecksum = errors.New("no checksum published")
+
+// checksumURL 返回下载地址对应的 .sha256sum, 保留地址中的参数
+func checksumURL(dl string) (string, error) {
+	u, err := url.Parse(dl)
+	if err != nil {
+		return "", err
+	}
+	u.Path += ".sha256sum"
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// fetchChecksum 获取与下载文件一同发布的 .sha256sum, 不存在时返回 errNoChecksum
+func fetchChecksum(client *http.Client, dl string) (string, error) {
+	sumURL, err := checksumURL(dl)
+	if err != nil {
+		return "", err
+	}
+	rsp, err := client.Get(sumURL)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode == http.StatusNotFound {
+		return "", errNoChecksum
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status: %s", rsp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid checksum: %q", data)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// backupFile 用硬链接保留旧文件, 使之后的 rename 仍然是原子的
+func backupFile(filePath string) error {
+	if _, err := os.Stat(filePath); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	bak := filePath + ".bak"
+	if err := os.Remove(bak); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Link(filePath, bak); err != nil {
+		return os.Rename(filePath, bak)
+	}
+	return nil
 }
@@ -0,0 +1,272 @@
+package command
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadFromURL(t *testing.T) {
+	output = t.TempDir()
+	verify = true
+	defer func() { output = "" }()
+
+	content := []byte("new geoip data")
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:]) + "  geoip.dat\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/geoip.dat":
+			_, _ = w.Write(content)
+		case "/geoip.dat.sha256sum":
+			_, _ = w.Write([]byte(checksum))
+		case "/custom.dat", "/private.dat":
+			_, _ = w.Write(content)
+		case "/private.dat.sha256sum":
+			if r.URL.Query().Get("token") != "abc" {
+				t.Errorf("checksum url: %s\n", r.URL)
+			}
+			http.Error(w, "forbidden", http.StatusForbidden)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	filePath := filepath.Join(output, "geoip.dat")
+	if err := os.WriteFile(filePath, []byte("old geoip data, which is longer"), 0644); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	if err := downloadFromURL(srv.Client(), srv.URL+"/geoip.dat", nil); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	data, _ := os.ReadFile(filePath)
+	if string(data) != string(content) {
+		t.Fatalf("content: %q\n", data)
+	}
+	bak, _ := os.ReadFile(filePath + ".bak")
+	if string(bak) != "old geoip data, which is longer" {
+		t.Fatalf("backup: %q\n", bak)
+	}
+
+	checksum = hex.EncodeToString(make([]byte, sha256.Size))
+	if err := downloadFromURL(srv.Client(), srv.URL+"/geoip.dat", nil); err == nil {
+		t.Fatalf("expected checksum mismatch\n")
+	}
+	data, _ = os.ReadFile(filePath)
+	if string(data) != string(content) {
+		t.Fatalf("failed download should keep the file: %q\n", data)
+	}
+
+	if err := downloadFromURL(srv.Client(), srv.URL+"/missing.dat", nil); err == nil {
+		t.Fatalf("expected error for missing file\n")
+	}
+
+	// 没有发布 .sha256sum 时只有 geo 数据源的文件必须校验
+	if err := downloadFromURL(srv.Client(), srv.URL+"/custom.dat", nil); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if err := downloadToFile(srv.Client(), srv.URL+"/custom.dat", filepath.Join(output, "custom.dat"), true, nil); err == nil {
+		t.Fatalf("expected error for missing checksum\n")
+	}
+	// 获取 .sha256sum 的其他错误也不影响任意地址的下载, 参数保留在 .sha256sum 的地址中
+	if err := downloadToFile(srv.Client(), srv.URL+"/private.dat?token=abc", filepath.Join(output, "private.dat"), false, nil); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if err := downloadToFile(srv.Client(), srv.URL+"/private.dat?token=abc", filepath.Join(output, "private.dat"), true, nil); err == nil {
+		t.Fatalf("expected error for forbidden checksum\n")
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	output = t.TempDir()
+	verify = false
+	defer func() {
+		output = ""
+		verify = true
+	}()
+
+	content := strings.Repeat("geosite", 1024)
+	modTime := time.Date(2022, 10, 19, 0, 0, 0, 0, time.UTC)
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "geosite.dat", modTime, strings.NewReader(content))
+	}))
+	defer srv.Close()
+
+	filePath := filepath.Join(output, "geosite.dat")
+	lastModified := modTime.Format(http.TimeFormat)
+	cases := []struct {
+		name      string
+		part      string
+		validator string
+		ranges    []string
+	}{
+		{name: "resume", part: content[:100], validator: lastModified, ranges: []string{"bytes=100-"}},
+		// 旧版本留下的 .part, If-Range 不匹配时服务端返回完整文件
+		{name: "old release", part: "old geosite", validator: modTime.Add(-time.Hour).Format(http.TimeFormat), ranges: []string{"bytes=11-"}},
+		{name: "no validator", part: "old geosite", ranges: []string{""}},
+		{name: "not satisfiable", part: content + "garbage", validator: lastModified, ranges: []string{fmt.Sprintf("bytes=%d-", len(content)+7), ""}},
+	}
+	for _, c := range cases {
+		ranges = nil
+		if err := os.WriteFile(filePath+".part", []byte(c.part), 0644); err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		_ = os.Remove(filePath + ".part.validator")
+		if c.validator != "" {
+			if err := os.WriteFile(filePath+".part.validator", []byte(c.validator), 0644); err != nil {
+				t.Fatalf("%s\n", err)
+			}
+		}
+
+		if err := downloadFromURL(srv.Client(), srv.URL+"/geosite.dat", nil); err != nil {
+			t.Fatalf("%s: %s\n", c.name, err)
+		}
+		data, _ := os.ReadFile(filePath)
+		if string(data) != content {
+			t.Fatalf("%s: content mismatch, len: %d\n", c.name, len(data))
+		}
+		if !reflect.DeepEqual(ranges, c.ranges) {
+			t.Fatalf("%s: ranges: %q, want: %q\n", c.name, ranges, c.ranges)
+		}
+	}
+
+	// 中断的下载保存了 Last-Modified, 下次可以续传
+	ranges = nil
+	_ = os.WriteFile(filePath+".part", []byte(content[:100]), 0644)
+	if err := downloadPart(srv.Client(), srv.URL+"/geosite.dat", filePath, nil); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if validator, _ := os.ReadFile(filePath + ".part.validator"); string(validator) != lastModified {
+		t.Fatalf("validator: %q\n", validator)
+	}
+}
+
+func TestGeoRelease(t *testing.T) {
+	dir := t.TempDir()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"tag_name":"202210192210","assets":[
+			{"name":"geoip.dat","browser_download_url":"` + srv.URL + `/geoip.dat"},
+			{"name":"dlc.dat","browser_download_url":"` + srv.URL + `/dlc.dat"}]}`))
+	}))
+	defer srv.Close()
+
+	s := &geoSource{
+		Name: "test",
+		Assets: []*geoAsset{
+			{File: geoIpFile, API: srv.URL, Name: "geoip.dat"},
+			{File: geoSiteFile, API: srv.URL, Name: "dlc.dat"},
+		},
+	}
+	releases, err := resolveGeoReleases(srv.Client(), s)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if len(releases) != 2 || releases[1].URL != srv.URL+"/dlc.dat" || releases[1].Tag != "202210192210" {
+		t.Fatalf("releases: %+v\n", releases)
+	}
+
+	manifest, err := loadGeoManifest(dir)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if manifest.UpToDate(releases[0]) {
+		t.Fatalf("nothing installed yet\n")
+	}
+	_ = os.WriteFile(filepath.Join(dir, geoIpFile), nil, 0644)
+	if err := manifest.Installed(releases[0]); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	manifest, err = loadGeoManifest(dir)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if !manifest.UpToDate(releases[0]) {
+		t.Fatalf("manifest: %+v\n", manifest.Files)
+	}
+
+	// 已经是最新的文件不再下载, 但是会返回给调用方
+	data, _ := json.Marshal([]*geoSource{s})
+	sourcesFile = filepath.Join(dir, "sources.json")
+	output = dir
+	defer func() { sourcesFile, output = "", "" }()
+	if err := os.WriteFile(sourcesFile, data, 0644); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	tasks, upToDate, err := getGeoTasks(srv.Client(), manifest, "test")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if len(tasks) != 1 || tasks[0].url != srv.URL+"/dlc.dat" || len(upToDate) != 1 || upToDate[0].Asset.File != geoIpFile {
+		t.Fatalf("tasks: %+v, up to date: %+v\n", tasks, upToDate)
+	}
+}
+
+func TestGetDownloadClient(t *testing.T) {
+	dir := t.TempDir()
+	vmessFile = filepath.Join(dir, "vmess.txt")
+	defer func() { vmessFile = "" }()
+	data, _ := json.Marshal([]*vmess{
+		{Ps: "hk", Add: "127.0.0.1", Port: 443, Id: "0c8d2f4e-1b3a-4c5d-8e9f-0a1b2c3d4e5f"},
+		{Ps: "bad", Add: "127.0.0.1", Port: 443, Id: "bad"},
+	})
+	if err := os.WriteFile(vmessFile, data, 0600); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	for _, c := range []struct {
+		via   string
+		proxy bool
+	}{
+		{via: "direct"},
+		{via: "env", proxy: true},
+	} {
+		client, closeClient, err := getDownloadClient(c.via)
+		if err != nil {
+			t.Fatalf("%s: %s\n", c.via, err)
+		}
+		closeClient()
+		if transport := client.Transport.(*http.Transport); (transport.Proxy != nil) != c.proxy {
+			t.Fatalf("%s: proxy: %v\n", c.via, transport.Proxy != nil)
+		}
+	}
+
+	for _, via := range []string{"proxy", "node=missing", "node=bad"} {
+		if _, _, err := getDownloadClient(via); err == nil {
+			t.Fatalf("want err for %s\n", via)
+		}
+	}
+
+	// node 模式经由 v2ray 实例拨号, 不会与占用 inbound 端口的 run 或 ping 冲突
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer l.Close()
+	defer func(port uint32) { inboundPort = port }(inboundPort)
+	inboundPort = uint32(l.Addr().(*net.TCPAddr).Port)
+
+	client, closeClient, err := getDownloadClient("node=hk")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer closeClient()
+	if transport := client.Transport.(*http.Transport); transport.Proxy != nil || transport.DialContext == nil {
+		t.Fatalf("node client should dial through v2ray\n")
+	}
+}
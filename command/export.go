@@ -0,0 +1,285 @@
+package command
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	formatJSON    = "json"
+	formatShare   = "share"
+	formatClash   = "clash"
+	formatSingbox = "singbox"
+)
+
+// exporter 把节点转换成客户端的配置, warnings 是被跳过或可能不兼容的节点
+type exporter struct {
+	contentType string
+	export      func(vmesses []*vmess) (data []byte, warnings []string, err error)
+}
+
+var exporters = map[string]*exporter{
+	formatJSON:    {contentType: "application/json", export: exportJSON},
+	formatShare:   {contentType: "text/plain; charset=utf-8", export: exportShare},
+	formatClash:   {contentType: "text/yaml; charset=utf-8", export: exportClash},
+	formatSingbox: {contentType: "application/json", export: exportSingbox},
+}
+
+func exportFormats() []string {
+	formats := make([]string, 0, len(exporters))
+	for f := range exporters {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+func findExporter(format string) (*exporter, error) {
+	e, ok := exporters[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown format: %s, supported: %s", format, strings.Join(exportFormats(), ", "))
+	}
+	return e, nil
+}
+
+func exportJSON(vmesses []*vmess) ([]byte, []string, error) {
+	data, err := json.Marshal(annotated(vmesses))
+	return append(data, '\n'), nil, err
+}
+
+// exportShare 生成与订阅相同的格式: base64 编码的分享链接列表
+func exportShare(vmesses []*vmess) ([]byte, []string, error) {
+	lines := make([]string, 0, len(vmesses))
+	for _, v := range vmesses {
+		lines = append(lines, v.ShareLink())
+	}
+	data := base64.StdEncoding.EncodeToString([]byte(strings.Join(lines, "\n")))
+	return []byte(data), nil, nil
+}
+
+func alterID(v *vmess) int {
+	aid, _ := strconv.Atoi(v.Aid)
+	return aid
+}
+
+type clashHTTPOpts struct {
+	Method  string              `yaml:"method"`
+	Path    []string            `yaml:"path"`
+	Headers map[string][]string `yaml:"headers,omitempty"`
+}
+
+type clashWSOpts struct {
+	Path    string            `yaml:"path,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+type clashH2Opts struct {
+	Host []string `yaml:"host,omitempty"`
+	Path string   `yaml:"path,omitempty"`
+}
+
+type clashGRPCOpts struct {
+	ServiceName string `yaml:"grpc-service-name"`
+}
+
+type clashProxy struct {
+	Name       string         `yaml:"name"`
+	Type       string         `yaml:"type"`
+	Server     string         `yaml:"server"`
+	Port       uint32         `yaml:"port"`
+	UUID       string         `yaml:"uuid"`
+	AlterID    int            `yaml:"alterId"`
+	Cipher     string         `yaml:"cipher"`
+	TLS        bool           `yaml:"tls,omitempty"`
+	ServerName string         `yaml:"servername,omitempty"`
+	Network    string         `yaml:"network,omitempty"`
+	HTTPOpts   *clashHTTPOpts `yaml:"http-opts,omitempty"`
+	WSOpts     *clashWSOpts   `yaml:"ws-opts,omitempty"`
+	H2Opts     *clashH2Opts   `yaml:"h2-opts,omitempty"`
+	GRPCOpts   *clashGRPCOpts `yaml:"grpc-opts,omitempty"`
+}
+
+type clashProxyGroup struct {
+	Name     string   `yaml:"name"`
+	Type     string   `yaml:"type"`
+	Proxies  []string `yaml:"proxies"`
+	URL      string   `yaml:"url,omitempty"`
+	Interval int      `yaml:"interval,omitempty"`
+}
+
+type clashConfig struct {
+	Proxies     []*clashProxy      `yaml:"proxies"`
+	ProxyGroups []*clashProxyGroup `yaml:"proxy-groups"`
+	Rules       []string           `yaml:"rules"`
+}
+
+// exportClash 生成 clash 配置, 包含一个手动选择和一个自动测速的分组
+func exportClash(vmesses []*vmess) ([]byte, []string, error) {
+	names, _ := indexVmess(vmesses)
+	cfg := &clashConfig{Rules: []string{"MATCH,PROXY"}}
+	var warnings []string
+	for i, v := range vmesses {
+		p := &clashProxy{
+			Name:    names[i],
+			Type:    "vmess",
+			Server:  v.Add,
+			Port:    v.Port,
+			UUID:    v.Id,
+			AlterID: alterID(v),
+			Cipher:  "auto",
+			TLS:     v.Tls == "tls",
+		}
+		if p.TLS && v.Host != "" {
+			p.ServerName = v.Host
+		}
+
+		switch v.Net {
+		case "", "tcp":
+			if v.Type == "http" {
+				p.Network = "http"
+				p.HTTPOpts = &clashHTTPOpts{Method: "GET", Path: []string{v.Path}}
+				if v.Host != "" {
+					p.HTTPOpts.Headers = map[string][]string{"Host": {v.Host}}
+				}
+			}
+		case "ws":
+			p.Network = "ws"
+			p.WSOpts = &clashWSOpts{Path: v.Path}
+			if v.Host != "" {
+				p.WSOpts.Headers = map[string]string{"Host": v.Host}
+			}
+		case "h2":
+			p.Network = "h2"
+			p.H2Opts = &clashH2Opts{Path: v.Path}
+			if v.Host != "" {
+				p.H2Opts.Host = []string{v.Host}
+			}
+		case "grpc":
+			p.Network = "grpc"
+			p.GRPCOpts = &clashGRPCOpts{ServiceName: v.Path}
+		default:
+			warnings = append(warnings, fmt.Sprintf("skip %s: clash does not support net %s", names[i], v.Net))
+			continue
+		}
+		cfg.Proxies = append(cfg.Proxies, p)
+	}
+
+	if len(cfg.Proxies) == 0 {
+		return nil, warnings, fmt.Errorf("no node can be exported")
+	}
+	var proxies []string
+	for _, p := range cfg.Proxies {
+		proxies = append(proxies, p.Name)
+	}
+	cfg.ProxyGroups = []*clashProxyGroup{
+		{Name: "PROXY", Type: "select", Proxies: append([]string{"AUTO"}, proxies...)},
+		{Name: "AUTO", Type: "url-test", Proxies: proxies, URL: "https://www.google.com/generate_204", Interval: 600},
+	}
+
+	data, err := yaml.Marshal(cfg)
+	return data, warnings, err
+}
+
+type singboxTLS struct {
+	Enabled    bool   `json:"enabled"`
+	ServerName string `json:"server_name,omitempty"`
+}
+
+type singboxTransport struct {
+	Type        string            `json:"type"`
+	Host        []string          `json:"host,omitempty"`
+	Path        string            `json:"path,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	ServiceName string            `json:"service_name,omitempty"`
+}
+
+type singboxOutbound struct {
+	Type       string            `json:"type"`
+	Tag        string            `json:"tag"`
+	Server     string            `json:"server,omitempty"`
+	ServerPort uint32            `json:"server_port,omitempty"`
+	UUID       string            `json:"uuid,omitempty"`
+	Security   string            `json:"security,omitempty"`
+	AlterID    int               `json:"alter_id,omitempty"`
+	TLS        *singboxTLS       `json:"tls,omitempty"`
+	Transport  *singboxTransport `json:"transport,omitempty"`
+	Outbounds  []string          `json:"outbounds,omitempty"`
+	Default    string            `json:"default,omitempty"`
+	URL        string            `json:"url,omitempty"`
+}
+
+type singboxConfig struct {
+	Outbounds []*singboxOutbound `json:"outbounds"`
+	Route     struct {
+		Final string `json:"final"`
+	} `json:"route"`
+}
+
+// exportSingbox 生成 sing-box 的出站配置,
+// sing-box 不支持 tcp 的 http 伪装头, 这类节点会被跳过
+func exportSingbox(vmesses []*vmess) ([]byte, []string, error) {
+	names, _ := indexVmess(vmesses)
+	cfg := &singboxConfig{}
+	var (
+		tags     []string
+		warnings []string
+	)
+	for i, v := range vmesses {
+		o := &singboxOutbound{
+			Type:       "vmess",
+			Tag:        names[i],
+			Server:     v.Add,
+			ServerPort: v.Port,
+			UUID:       v.Id,
+			Security:   "auto",
+			AlterID:    alterID(v),
+		}
+		if v.Tls == "tls" {
+			o.TLS = &singboxTLS{Enabled: true, ServerName: v.Host}
+		}
+
+		switch v.Net {
+		case "", "tcp":
+			if v.Type == "http" {
+				warnings = append(warnings, fmt.Sprintf("skip %s: sing-box does not support tcp http header", names[i]))
+				continue
+			}
+		case "ws":
+			o.Transport = &singboxTransport{Type: "ws", Path: v.Path}
+			if v.Host != "" {
+				o.Transport.Headers = map[string]string{"Host": v.Host}
+			}
+		case "h2":
+			o.Transport = &singboxTransport{Type: "http", Path: v.Path}
+			if v.Host != "" {
+				o.Transport.Host = []string{v.Host}
+			}
+		case "grpc":
+			o.Transport = &singboxTransport{Type: "grpc", ServiceName: v.Path}
+		default:
+			warnings = append(warnings, fmt.Sprintf("skip %s: sing-box does not support net %s", names[i], v.Net))
+			continue
+		}
+		cfg.Outbounds = append(cfg.Outbounds, o)
+		tags = append(tags, o.Tag)
+	}
+
+	if len(tags) == 0 {
+		return nil, warnings, fmt.Errorf("no node can be exported")
+	}
+	cfg.Outbounds = append(cfg.Outbounds,
+		&singboxOutbound{Type: "selector", Tag: "proxy", Outbounds: append([]string{"auto"}, tags...), Default: "auto"},
+		&singboxOutbound{Type: "urltest", Tag: "auto", Outbounds: tags, URL: "https://www.google.com/generate_204"},
+		&singboxOutbound{Type: "direct", Tag: "direct"},
+	)
+	cfg.Route.Final = "proxy"
+
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	return append(data, '\n'), warnings, err
+}
@@ -0,0 +1,54 @@
+package command
+
+import (
+	"bytes"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestExport(t *testing.T) {
+	vmesses := []*vmess{
+		{Ps: "a", Id: "2015cdb0-4f09-4796-7ec6-91b2e5dc2923", Add: "a.example.com", Port: 443, Aid: "0", Net: "ws", Path: "/ws", Host: "cdn.example.com", Tls: "tls"},
+		{Ps: "b", Id: "2015cdb0-4f09-4796-7ec6-91b2e5dc2923", Add: "b.example.com", Port: 80, Type: "http", Path: "/", Host: "example.com"},
+		{Ps: "c", Id: "2015cdb0-4f09-4796-7ec6-91b2e5dc2923", Add: "c.example.com", Port: 80, Net: "kcp"},
+	}
+
+	data, _, err := exportShare(vmesses)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	parsed, err := parseFromReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if d := diffVmess(vmesses, parsed); !d.Empty() {
+		t.Fatalf("share round trip: %+v\n", d)
+	}
+
+	data, warnings, err := exportClash(vmesses)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("warnings: %v\n", warnings)
+	}
+	cfg := &clashConfig{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if len(cfg.Proxies) != 2 || cfg.Proxies[0].WSOpts.Headers["Host"] != "cdn.example.com" ||
+		!cfg.Proxies[0].TLS || cfg.Proxies[1].Network != "http" {
+		t.Fatalf("clash: %s\n", data)
+	}
+	if len(cfg.ProxyGroups) != 2 || len(cfg.ProxyGroups[0].Proxies) != 3 {
+		t.Fatalf("clash groups: %s\n", data)
+	}
+
+	if _, _, err := exportSingbox(vmesses[1:]); err == nil {
+		t.Fatalf("singbox should fail without exportable nodes\n")
+	}
+	if _, err := findExporter("nope"); err == nil {
+		t.Fatalf("unknown format accepted\n")
+	}
+}
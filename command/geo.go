@@ -0,0 +1,254 @@
+package command
+
+import (
+	"net"
+	"sort"
+
+	"github.com/jdxj/v2ray-bot/logger"
+	"github.com/spf13/cobra"
+)
+
+var geo = &cobra.Command{
+	Use:        "geo",
+	Aliases:    nil,
+	SuggestFor: nil,
+	Short:      "inspect geoip.dat and geosite.dat",
+	Long: `example:
+  geo ip 8.8.8.8
+  geo site www.google.com
+  geo list site`,
+	Example:                    "",
+	ValidArgs:                  nil,
+	ValidArgsFunction:          nil,
+	Args:                       nil,
+	ArgAliases:                 nil,
+	BashCompletionFunction:     "",
+	Deprecated:                 "",
+	Annotations:                nil,
+	Version:                    "",
+	PersistentPreRun:           nil,
+	PersistentPreRunE:          nil,
+	PreRun:                     nil,
+	PreRunE:                    nil,
+	Run:                        nil,
+	RunE:                       nil,
+	PostRun:                    nil,
+	PostRunE:                   nil,
+	PersistentPostRun:          nil,
+	PersistentPostRunE:         nil,
+	FParseErrWhitelist:         cobra.FParseErrWhitelist{},
+	CompletionOptions:          cobra.CompletionOptions{},
+	TraverseChildren:           false,
+	Hidden:                     false,
+	SilenceErrors:              false,
+	SilenceUsage:               false,
+	DisableFlagParsing:         false,
+	DisableAutoGenTag:          false,
+	DisableFlagsInUseLine:      false,
+	DisableSuggestions:         false,
+	SuggestionsMinimumDistance: 0,
+}
+
+var geoIPCmd = &cobra.Command{
+	Use:        "ip",
+	Aliases:    nil,
+	SuggestFor: nil,
+	Short:      "show the categories of ips",
+	Long: `example:
+  geo ip 8.8.8.8 1.1.1.1`,
+	Example:                    "",
+	ValidArgs:                  nil,
+	ValidArgsFunction:          nil,
+	Args:                       cobra.MinimumNArgs(1),
+	ArgAliases:                 nil,
+	BashCompletionFunction:     "",
+	Deprecated:                 "",
+	Annotations:                nil,
+	Version:                    "",
+	PersistentPreRun:           nil,
+	PersistentPreRunE:          nil,
+	PreRun:                     nil,
+	PreRunE:                    nil,
+	Run:                        geoIPRun,
+	RunE:                       nil,
+	PostRun:                    nil,
+	PostRunE:                   nil,
+	PersistentPostRun:          nil,
+	PersistentPostRunE:         nil,
+	FParseErrWhitelist:         cobra.FParseErrWhitelist{},
+	CompletionOptions:          cobra.CompletionOptions{},
+	TraverseChildren:           false,
+	Hidden:                     false,
+	SilenceErrors:              false,
+	SilenceUsage:               false,
+	DisableFlagParsing:         false,
+	DisableAutoGenTag:          false,
+	DisableFlagsInUseLine:      false,
+	DisableSuggestions:         false,
+	SuggestionsMinimumDistance: 0,
+}
+
+var geoSiteCmd = &cobra.Command{
+	Use:        "site",
+	Aliases:    nil,
+	SuggestFor: nil,
+	Short:      "show the categories of domains",
+	Long: `example:
+  geo site www.google.com`,
+	Example:                    "",
+	ValidArgs:                  nil,
+	ValidArgsFunction:          nil,
+	Args:                       cobra.MinimumNArgs(1),
+	ArgAliases:                 nil,
+	BashCompletionFunction:     "",
+	Deprecated:                 "",
+	Annotations:                nil,
+	Version:                    "",
+	PersistentPreRun:           nil,
+	PersistentPreRunE:          nil,
+	PreRun:                     nil,
+	PreRunE:                    nil,
+	Run:                        geoSiteRun,
+	RunE:                       nil,
+	PostRun:                    nil,
+	PostRunE:                   nil,
+	PersistentPostRun:          nil,
+	PersistentPostRunE:         nil,
+	FParseErrWhitelist:         cobra.FParseErrWhitelist{},
+	CompletionOptions:          cobra.CompletionOptions{},
+	TraverseChildren:           false,
+	Hidden:                     false,
+	SilenceErrors:              false,
+	SilenceUsage:               false,
+	DisableFlagParsing:         false,
+	DisableAutoGenTag:          false,
+	DisableFlagsInUseLine:      false,
+	DisableSuggestions:         false,
+	SuggestionsMinimumDistance: 0,
+}
+
+var geoListCmd = &cobra.Command{
+	Use:        "list",
+	Aliases:    nil,
+	SuggestFor: nil,
+	Short:      "list categories and entry counts",
+	Long: `example:
+  geo list ip
+  geo list site`,
+	Example:                    "",
+	ValidArgs:                  []string{"ip", "site"},
+	ValidArgsFunction:          nil,
+	Args:                       cobra.ExactValidArgs(1),
+	ArgAliases:                 nil,
+	BashCompletionFunction:     "",
+	Deprecated:                 "",
+	Annotations:                nil,
+	Version:                    "",
+	PersistentPreRun:           nil,
+	PersistentPreRunE:          nil,
+	PreRun:                     nil,
+	PreRunE:                    nil,
+	Run:                        geoListRun,
+	RunE:                       nil,
+	PostRun:                    nil,
+	PostRunE:                   nil,
+	PersistentPostRun:          nil,
+	PersistentPostRunE:         nil,
+	FParseErrWhitelist:         cobra.FParseErrWhitelist{},
+	CompletionOptions:          cobra.CompletionOptions{},
+	TraverseChildren:           false,
+	Hidden:                     false,
+	SilenceErrors:              false,
+	SilenceUsage:               false,
+	DisableFlagParsing:         false,
+	DisableAutoGenTag:          false,
+	DisableFlagsInUseLine:      false,
+	DisableSuggestions:         false,
+	SuggestionsMinimumDistance: 0,
+}
+
+var (
+	geoSite     string
+	nameGeoSite = "geosite"
+)
+
+func init() {
+	rootCmd.AddCommand(geo)
+	geo.AddCommand(geoIPCmd, geoSiteCmd, geoListCmd)
+
+	geo.PersistentFlags().
+		StringVar(&geoIP, nameGeoIP, geoIpFile, "path of geoip.dat")
+
+	geo.PersistentFlags().
+		StringVar(&geoSite, nameGeoSite, geoSiteFile, "path of geosite.dat")
+}
+
+func geoIPRun(cmd *cobra.Command, args []string) {
+	db, err := loadGeoIPDB(geoIP)
+	if err != nil {
+		cmd.PrintErrf("load %s err: %s\n", geoIP, err)
+		return
+	}
+
+	for _, arg := range args {
+		ip := net.ParseIP(arg)
+		if ip == nil {
+			logger.Warnw("invalid ip", "ip", arg)
+			continue
+		}
+		cmd.Printf("%s: %v\n", arg, db.Lookup(ip))
+	}
+}
+
+func geoSiteRun(cmd *cobra.Command, args []string) {
+	db, err := loadGeoSiteDB(geoSite)
+	if err != nil {
+		cmd.PrintErrf("load %s err: %s\n", geoSite, err)
+		return
+	}
+
+	for _, arg := range args {
+		cmd.Printf("%s: %v\n", arg, db.Lookup(arg))
+	}
+}
+
+type geoCount struct {
+	code  string
+	count int
+}
+
+func geoListRun(cmd *cobra.Command, args []string) {
+	var (
+		counts []geoCount
+		total  int
+	)
+	switch args[0] {
+	case "ip":
+		list, err := loadGeoIPList(geoIP)
+		if err != nil {
+			cmd.PrintErrf("load %s err: %s\n", geoIP, err)
+			return
+		}
+		for _, entry := range list.GetEntry() {
+			counts = append(counts, geoCount{code: entry.GetCountryCode(), count: len(entry.GetCidr())})
+		}
+	case "site":
+		list, err := loadGeoSiteList(geoSite)
+		if err != nil {
+			cmd.PrintErrf("load %s err: %s\n", geoSite, err)
+			return
+		}
+		for _, entry := range list.GetEntry() {
+			counts = append(counts, geoCount{code: entry.GetCountryCode(), count: len(entry.GetDomain())})
+		}
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		return counts[i].code < counts[j].code
+	})
+	for _, c := range counts {
+		cmd.Printf("%-32s %d\n", c.code, c.count)
+		total += c.count
+	}
+	cmd.Printf("%d categories, %d entries\n", len(counts), total)
+}
@@ -0,0 +1,148 @@
+package command
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+)
+
+func TestGeoIPDB(t *testing.T) {
+	list := &routercommon.GeoIPList{
+		Entry: []*routercommon.GeoIP{
+			{
+				CountryCode: "PRIVATE",
+				Cidr:        []*routercommon.CIDR{{Ip: net.ParseIP("10.0.0.0").To4(), Prefix: 8}},
+			},
+			{
+				CountryCode: "CN",
+				Cidr:        []*routercommon.CIDR{{Ip: net.ParseIP("1.0.1.0").To4(), Prefix: 24}},
+			},
+		},
+	}
+	db, err := newGeoIPDB(list)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	if country := db.Country(net.ParseIP("1.0.1.1")); country != "cn" {
+		t.Fatalf("country: %s\n", country)
+	}
+	if codes := db.Lookup(net.ParseIP("10.1.1.1")); !reflect.DeepEqual(codes, []string{"private"}) {
+		t.Fatalf("codes: %v\n", codes)
+	}
+	if country := db.Country(net.ParseIP("10.1.1.1")); country != "" {
+		t.Fatalf("country: %s\n", country)
+	}
+}
+
+func TestGeoSiteDB(t *testing.T) {
+	list := &routercommon.GeoSiteList{
+		Entry: []*routercommon.GeoSite{
+			{
+				CountryCode: "GOOGLE",
+				Domain: []*routercommon.Domain{
+					{Type: routercommon.Domain_RootDomain, Value: "google.com"},
+				},
+			},
+			{
+				CountryCode: "ADS",
+				Domain: []*routercommon.Domain{
+					{Type: routercommon.Domain_Plain, Value: "ads"},
+					{Type: routercommon.Domain_Regex, Value: `^ad\d+\.`},
+					{Type: routercommon.Domain_Full, Value: "tracker.example.com"},
+				},
+			},
+		},
+	}
+	db := newGeoSiteDB(list)
+
+	cases := map[string][]string{
+		"www.google.com":          {"google"},
+		"ads.google.com":          {"google", "ads"},
+		"ad12.example.com":        {"ads"},
+		"tracker.example.com":     {"ads"},
+		"sub.tracker.example.com": nil,
+		"notgoogle.com":           nil,
+	}
+	for domain, want := range cases {
+		if got := db.Lookup(domain); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %v, want %v\n", domain, got, want)
+		}
+	}
+}
+
+func TestCompileGeoSites(t *testing.T) {
+	lists := map[string][]string{
+		"COMPANY": {"company.com", "full:vpn.company.net @cn", "include:ads"},
+		"ADS":     {"keyword:tracker", `regexp:^ad\d+\.`, "include:google"},
+	}
+	upstream := &routercommon.GeoSiteList{
+		Entry: []*routercommon.GeoSite{
+			{
+				CountryCode: "GOOGLE",
+				Domain:      []*routercommon.Domain{{Type: routercommon.Domain_RootDomain, Value: "google.com"}},
+			},
+			{
+				CountryCode: "ADS",
+				Domain:      []*routercommon.Domain{{Type: routercommon.Domain_Plain, Value: "tracker"}},
+			},
+		},
+	}
+
+	built, err := compileGeoSites(lists, upstream)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	merged := mergeGeoSites(upstream, built)
+	if len(merged.Entry) != 3 {
+		t.Fatalf("entries: %d\n", len(merged.Entry))
+	}
+
+	db := newGeoSiteDB(merged)
+	cases := map[string][]string{
+		"www.company.com":  {"company"},
+		"vpn.company.net":  {"company"},
+		"ad1.example.com":  {"ads", "company"},
+		"mail.google.com":  {"ads", "company", "google"},
+		"www.company.net":  nil,
+		"tracker.test.com": {"ads", "company"},
+	}
+	for domain, want := range cases {
+		if got := db.Lookup(domain); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %v, want %v\n", domain, got, want)
+		}
+	}
+
+	lists["ADS"] = append(lists["ADS"], "include:company")
+	if _, err := compileGeoSites(lists, upstream); err == nil {
+		t.Fatalf("expected include cycle\n")
+	}
+}
+
+func TestCompileGeoIPs(t *testing.T) {
+	built, err := compileGeoIPs(map[string][]string{
+		"OFFICE": {"192.168.10.0/24", "203.0.113.7", "2001:db8::/32"},
+	})
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	db, err := newGeoIPDB(mergeGeoIPs(&routercommon.GeoIPList{}, built))
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	for _, ip := range []string{"192.168.10.1", "203.0.113.7", "2001:db8::1"} {
+		if codes := db.Lookup(net.ParseIP(ip)); !reflect.DeepEqual(codes, []string{"office"}) {
+			t.Fatalf("%s: %v\n", ip, codes)
+		}
+	}
+	if codes := db.Lookup(net.ParseIP("203.0.113.8")); codes != nil {
+		t.Fatalf("codes: %v\n", codes)
+	}
+
+	if _, err := compileGeoIPs(map[string][]string{"BAD": {"300.1.1.1"}}); err == nil {
+		t.Fatalf("expected invalid ip\n")
+	}
+}
@@ -0,0 +1,411 @@
+package command
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jdxj/v2ray-bot/logger"
+	"github.com/spf13/cobra"
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+	"google.golang.org/protobuf/proto"
+)
+
+var geoBuildCmd = &cobra.Command{
+	Use:        "build",
+	Aliases:    nil,
+	SuggestFor: nil,
+	Short:      "build geosite.dat/geoip.dat from text lists",
+	Long: `example:
+  geo build --site-dir data --ip-dir cidr
+  geo build --site-dir data --merge --geosite geosite.dat --site-out custom.dat
+
+each file in --site-dir is a category named after the file, one rule per line:
+  domain:example.com, full:www.example.com, regexp:^ad\d+\., keyword:ads, include:other
+  a rule without prefix is a domain rule, attributes follow as @attr
+each file in --ip-dir is a category named after the file, one CIDR or IP per line`,
+	Example:                    "",
+	ValidArgs:                  nil,
+	ValidArgsFunction:          nil,
+	Args:                       nil,
+	ArgAliases:                 nil,
+	BashCompletionFunction:     "",
+	Deprecated:                 "",
+	Annotations:                nil,
+	Version:                    "",
+	PersistentPreRun:           nil,
+	PersistentPreRunE:          nil,
+	PreRun:                     nil,
+	PreRunE:                    nil,
+	Run:                        geoBuildRun,
+	RunE:                       nil,
+	PostRun:                    nil,
+	PostRunE:                   nil,
+	PersistentPostRun:          nil,
+	PersistentPostRunE:         nil,
+	FParseErrWhitelist:         cobra.FParseErrWhitelist{},
+	CompletionOptions:          cobra.CompletionOptions{},
+	TraverseChildren:           false,
+	Hidden:                     false,
+	SilenceErrors:              false,
+	SilenceUsage:               false,
+	DisableFlagParsing:         false,
+	DisableAutoGenTag:          false,
+	DisableFlagsInUseLine:      false,
+	DisableSuggestions:         false,
+	SuggestionsMinimumDistance: 0,
+}
+
+var (
+	siteDir     string
+	nameSiteDir = "site-dir"
+
+	ipDir     string
+	nameIPDir = "ip-dir"
+
+	siteOut     string
+	nameSiteOut = "site-out"
+
+	ipOut     string
+	nameIPOut = "ip-out"
+
+	merge     bool
+	nameMerge = "merge"
+)
+
+func init() {
+	geo.AddCommand(geoBuildCmd)
+
+	geoBuildCmd.Flags().
+		StringVar(&siteDir, nameSiteDir, "", "directory of domain lists")
+
+	geoBuildCmd.Flags().
+		StringVar(&ipDir, nameIPDir, "", "directory of CIDR lists")
+
+	geoBuildCmd.Flags().
+		StringVar(&siteOut, nameSiteOut, geoSiteFile, "output path of the built geosite")
+
+	geoBuildCmd.Flags().
+		StringVar(&ipOut, nameIPOut, geoIpFile, "output path of the built geoip")
+
+	geoBuildCmd.Flags().
+		BoolVar(&merge, nameMerge, false, "merge into --geosite/--geoip instead of building from scratch")
+}
+
+func geoBuildRun(cmd *cobra.Command, args []string) {
+	if siteDir == "" && ipDir == "" {
+		cmd.PrintErrln("geo build requires --site-dir or --ip-dir")
+		return
+	}
+
+	if siteDir != "" {
+		if err := buildGeoSite(); err != nil {
+			cmd.PrintErrf("build geosite err: %s\n", err)
+			return
+		}
+		logger.Infow("geo data built", "file", siteOut)
+	}
+	if ipDir != "" {
+		if err := buildGeoIP(); err != nil {
+			cmd.PrintErrf("build geoip err: %s\n", err)
+			return
+		}
+		logger.Infow("geo data built", "file", ipOut)
+	}
+}
+
+func buildGeoSite() error {
+	upstream := &routercommon.GeoSiteList{}
+	if merge {
+		var err error
+		upstream, err = loadGeoSiteList(geoSite)
+		if err != nil {
+			return err
+		}
+	}
+
+	lists, err := readListDir(siteDir)
+	if err != nil {
+		return err
+	}
+	built, err := compileGeoSites(lists, upstream)
+	if err != nil {
+		return err
+	}
+	return writeProto(siteOut, mergeGeoSites(upstream, built))
+}
+
+func buildGeoIP() error {
+	upstream := &routercommon.GeoIPList{}
+	if merge {
+		var err error
+		upstream, err = loadGeoIPList(geoIP)
+		if err != nil {
+			return err
+		}
+	}
+
+	lists, err := readListDir(ipDir)
+	if err != nil {
+		return err
+	}
+	built, err := compileGeoIPs(lists)
+	if err != nil {
+		return err
+	}
+	return writeProto(ipOut, mergeGeoIPs(upstream, built))
+}
+
+// readListDir 读取目录下的所有列表, 以大写的文件名作为分类, 忽略空行和 # 注释
+func readListDir(dir string) (map[string][]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	lists := make(map[string][]string)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		lines, err := readListFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		lists[strings.ToUpper(name)] = lines
+	}
+	return lists, nil
+}
+
+func readListFile(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// compileGeoSites 编译域名列表, include 优先引用本地列表, 其次引用 upstream 中的分类
+func compileGeoSites(lists map[string][]string, upstream *routercommon.GeoSiteList) ([]*routercommon.GeoSite, error) {
+	upstreamSites := make(map[string]*routercommon.GeoSite)
+	for _, site := range upstream.GetEntry() {
+		upstreamSites[strings.ToUpper(site.GetCountryCode())] = site
+	}
+
+	compiled := make(map[string][]*routercommon.Domain)
+	var compile func(code string, visiting map[string]bool) ([]*routercommon.Domain, error)
+	compile = func(code string, visiting map[string]bool) ([]*routercommon.Domain, error) {
+		if domains, ok := compiled[code]; ok {
+			return domains, nil
+		}
+		lines, ok := lists[code]
+		if !ok {
+			if site, ok := upstreamSites[code]; ok {
+				return site.GetDomain(), nil
+			}
+			return nil, fmt.Errorf("list %s not found", strings.ToLower(code))
+		}
+		if visiting[code] {
+			return nil, fmt.Errorf("include cycle at %s", strings.ToLower(code))
+		}
+		visiting[code] = true
+		defer delete(visiting, code)
+
+		var domains []*routercommon.Domain
+		for _, line := range lines {
+			if strings.HasPrefix(line, "include:") {
+				included, err := compile(strings.ToUpper(strings.TrimPrefix(line, "include:")), visiting)
+				if err != nil {
+					return nil, err
+				}
+				domains = append(domains, included...)
+				continue
+			}
+
+			d, err := parseDomainRule(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", strings.ToLower(code), err)
+			}
+			domains = append(domains, d)
+		}
+		compiled[code] = domains
+		return domains, nil
+	}
+
+	var sites []*routercommon.GeoSite
+	for code := range lists {
+		domains, err := compile(code, make(map[string]bool))
+		if err != nil {
+			return nil, err
+		}
+		sites = append(sites, &routercommon.GeoSite{CountryCode: code, Domain: domains})
+	}
+	return sites, nil
+}
+
+func parseDomainRule(line string) (*routercommon.Domain, error) {
+	fields := strings.Fields(line)
+	rule := fields[0]
+
+	d := &routercommon.Domain{Type: routercommon.Domain_RootDomain, Value: rule}
+	if i := strings.Index(rule, ":"); i >= 0 {
+		switch prefix := rule[:i]; prefix {
+		case "domain":
+			d.Type = routercommon.Domain_RootDomain
+		case "full":
+			d.Type = routercommon.Domain_Full
+		case "regexp":
+			d.Type = routercommon.Domain_Regex
+		case "keyword":
+			d.Type = routercommon.Domain_Plain
+		default:
+			return nil, fmt.Errorf("unknown rule type: %s", prefix)
+		}
+		d.Value = rule[i+1:]
+	}
+	if d.Value == "" {
+		return nil, fmt.Errorf("empty rule: %s", line)
+	}
+	if d.Type != routercommon.Domain_Regex {
+		d.Value = strings.ToLower(d.Value)
+	}
+
+	for _, attr := range fields[1:] {
+		if !strings.HasPrefix(attr, "@") {
+			return nil, fmt.Errorf("invalid attribute: %s", attr)
+		}
+		d.Attribute = append(d.Attribute, &routercommon.Domain_Attribute{
+			Key:        strings.ToLower(strings.TrimPrefix(attr, "@")),
+			TypedValue: &routercommon.Domain_Attribute_BoolValue{BoolValue: true},
+		})
+	}
+	return d, nil
+}
+
+func compileGeoIPs(lists map[string][]string) ([]*routercommon.GeoIP, error) {
+	var geoIPs []*routercommon.GeoIP
+	for code, lines := range lists {
+		geoIP := &routercommon.GeoIP{CountryCode: code}
+		for _, line := range lines {
+			cidr, err := parseCIDR(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", strings.ToLower(code), err)
+			}
+			geoIP.Cidr = append(geoIP.Cidr, cidr)
+		}
+		geoIPs = append(geoIPs, geoIP)
+	}
+	return geoIPs, nil
+}
+
+func parseCIDR(line string) (*routercommon.CIDR, error) {
+	if !strings.Contains(line, "/") {
+		ip := net.ParseIP(line)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip: %s", line)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &routercommon.CIDR{Ip: ip4, Prefix: 32}, nil
+		}
+		return &routercommon.CIDR{Ip: ip, Prefix: 128}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(line)
+	if err != nil {
+		return nil, err
+	}
+	ones, _ := ipNet.Mask.Size()
+	ip := ipNet.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &routercommon.CIDR{Ip: ip, Prefix: uint32(ones)}, nil
+}
+
+// mergeGeoSites 将 built 合并到 upstream, 同名分类追加规则
+func mergeGeoSites(upstream *routercommon.GeoSiteList, built []*routercommon.GeoSite) *routercommon.GeoSiteList {
+	index := make(map[string]*routercommon.GeoSite)
+	result := &routercommon.GeoSiteList{}
+	for _, site := range upstream.GetEntry() {
+		index[strings.ToUpper(site.GetCountryCode())] = site
+		result.Entry = append(result.Entry, site)
+	}
+
+	for _, site := range built {
+		exist, ok := index[site.CountryCode]
+		if !ok {
+			result.Entry = append(result.Entry, site)
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, d := range exist.Domain {
+			seen[d.GetType().String()+":"+d.GetValue()] = true
+		}
+		for _, d := range site.Domain {
+			if !seen[d.GetType().String()+":"+d.GetValue()] {
+				exist.Domain = append(exist.Domain, d)
+			}
+		}
+	}
+
+	sort.Slice(result.Entry, func(i, j int) bool {
+		return result.Entry[i].CountryCode < result.Entry[j].CountryCode
+	})
+	return result
+}
+
+// mergeGeoIPs 将 built 合并到 upstream, 同名分类追加 CIDR
+func mergeGeoIPs(upstream *routercommon.GeoIPList, built []*routercommon.GeoIP) *routercommon.GeoIPList {
+	index := make(map[string]*routercommon.GeoIP)
+	result := &routercommon.GeoIPList{}
+	for _, geoIP := range upstream.GetEntry() {
+		index[strings.ToUpper(geoIP.GetCountryCode())] = geoIP
+		result.Entry = append(result.Entry, geoIP)
+	}
+
+	for _, geoIP := range built {
+		exist, ok := index[geoIP.CountryCode]
+		if !ok {
+			result.Entry = append(result.Entry, geoIP)
+			continue
+		}
+		exist.Cidr = append(exist.Cidr, geoIP.Cidr...)
+	}
+
+	sort.Slice(result.Entry, func(i, j int) bool {
+		return result.Entry[i].CountryCode < result.Entry[j].CountryCode
+	})
+	return result
+}
+
+func writeProto(filename string, m proto.Message) error {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,153 @@
+package command
+
+import (
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/v2fly/v2ray-core/v5/app/router"
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	geoIpFile   = "geoip.dat"
+	geoSiteFile = "geosite.dat"
+)
+
+func loadGeoIPList(filename string) (*routercommon.GeoIPList, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &routercommon.GeoIPList{}
+	return list, proto.Unmarshal(data, list)
+}
+
+type geoIPMatcher struct {
+	code    string
+	matcher *router.GeoIPMatcher
+}
+
+// geoIPDB 按 geoip.dat 中的顺序匹配 IP 所属的分类
+type geoIPDB struct {
+	matchers []*geoIPMatcher
+}
+
+func newGeoIPDB(list *routercommon.GeoIPList) (*geoIPDB, error) {
+	db := &geoIPDB{}
+	for _, entry := range list.GetEntry() {
+		m := &router.GeoIPMatcher{}
+		if err := m.Init(entry.GetCidr()); err != nil {
+			return nil, err
+		}
+		db.matchers = append(db.matchers, &geoIPMatcher{
+			code:    strings.ToLower(entry.GetCountryCode()),
+			matcher: m,
+		})
+	}
+	return db, nil
+}
+
+func loadGeoIPDB(filename string) (*geoIPDB, error) {
+	list, err := loadGeoIPList(filename)
+	if err != nil {
+		return nil, err
+	}
+	return newGeoIPDB(list)
+}
+
+// Lookup 返回包含该 IP 的所有分类
+func (db *geoIPDB) Lookup(ip net.IP) []string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	var codes []string
+	for _, m := range db.matchers {
+		if m.matcher.Match(ip) {
+			codes = append(codes, m.code)
+		}
+	}
+	return codes
+}
+
+// Country 返回第一个匹配的两位国家代码, geoip.dat 中还包含 private, telegram 等非国家分类
+func (db *geoIPDB) Country(ip net.IP) string {
+	for _, code := range db.Lookup(ip) {
+		if len(code) == 2 {
+			return code
+		}
+	}
+	return ""
+}
+
+func loadGeoSiteList(filename string) (*routercommon.GeoSiteList, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &routercommon.GeoSiteList{}
+	return list, proto.Unmarshal(data, list)
+}
+
+// geoSiteDB 查询域名所属的 geosite 分类
+type geoSiteDB struct {
+	list    *routercommon.GeoSiteList
+	regexes map[string]*regexp.Regexp
+}
+
+func newGeoSiteDB(list *routercommon.GeoSiteList) *geoSiteDB {
+	return &geoSiteDB{
+		list:    list,
+		regexes: make(map[string]*regexp.Regexp),
+	}
+}
+
+func loadGeoSiteDB(filename string) (*geoSiteDB, error) {
+	list, err := loadGeoSiteList(filename)
+	if err != nil {
+		return nil, err
+	}
+	return newGeoSiteDB(list), nil
+}
+
+// Lookup 返回包含该域名的所有分类
+func (db *geoSiteDB) Lookup(domain string) []string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	var codes []string
+	for _, site := range db.list.GetEntry() {
+		for _, d := range site.GetDomain() {
+			if db.match(d, domain) {
+				codes = append(codes, strings.ToLower(site.GetCountryCode()))
+				break
+			}
+		}
+	}
+	return codes
+}
+
+func (db *geoSiteDB) match(d *routercommon.Domain, domain string) bool {
+	value := strings.ToLower(d.GetValue())
+	switch d.GetType() {
+	case routercommon.Domain_Plain:
+		return strings.Contains(domain, value)
+	case routercommon.Domain_Regex:
+		re, ok := db.regexes[d.GetValue()]
+		if !ok {
+			// 无效的正则表达式缓存为 nil, 不再重复编译
+			re, _ = regexp.Compile(d.GetValue())
+			db.regexes[d.GetValue()] = re
+		}
+		return re != nil && re.MatchString(domain)
+	case routercommon.Domain_RootDomain:
+		return domain == value || strings.HasSuffix(domain, "."+value)
+	case routercommon.Domain_Full:
+		return domain == value
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// geoAsset 是 release 中的一个文件
+type geoAsset struct {
+	// 本地文件名
+	File string `json:"file"`
+	// 兼容 GitHub releases API 的仓库地址
+	API string `json:"api"`
+	// release 中的文件名
+	Name string `json:"name"`
+	// release 中是否有对应的 .sha256sum, 有时下载必须校验
+	Checksum bool `json:"checksum"`
+}
+
+type geoSource struct {
+	Name string `json:"name"`
+	// 下载镜像, 拼接在下载地址之前, 例如 https://ghproxy.com/
+	Mirror string      `json:"mirror"`
+	Assets []*geoAsset `json:"assets"`
+}
+
+var builtinGeoSources = []*geoSource{
+	{
+		Name: "loyalsoldier",
+		Assets: []*geoAsset{
+			{File: geoIpFile, API: "https://api.github.com/repos/Loyalsoldier/v2ray-rules-dat", Name: "geoip.dat", Checksum: true},
+			{File: geoSiteFile, API: "https://api.github.com/repos/Loyalsoldier/v2ray-rules-dat", Name: "geosite.dat", Checksum: true},
+		},
+	},
+	{
+		Name: "v2fly",
+		Assets: []*geoAsset{
+			{File: geoIpFile, API: "https://api.github.com/repos/v2fly/geoip", Name: "geoip.dat", Checksum: true},
+			{File: geoSiteFile, API: "https://api.github.com/repos/v2fly/domain-list-community", Name: "dlc.dat", Checksum: true},
+		},
+	},
+}
+
+// loadGeoSources 返回内置的数据源以及 sourcesFile 中自定义的数据源, 同名时自定义的优先
+func loadGeoSources(sourcesFile string) ([]*geoSource, error) {
+	sources := builtinGeoSources
+	if sourcesFile == "" {
+		return sources, nil
+	}
+
+	data, err := os.ReadFile(sourcesFile)
+	if err != nil {
+		return nil, err
+	}
+	var custom []*geoSource
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return nil, err
+	}
+	return append(custom, sources...), nil
+}
+
+func findGeoSource(sources []*geoSource, name string) (*geoSource, error) {
+	for _, s := range sources {
+		if s.Name == name {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown geo source: %s", name)
+}
+
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name               string `json:"name"`
+		BrowserDownloadURL string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func getLatestRelease(client *http.Client, api string) (*githubRelease, error) {
+	req, err := http.NewRequest(http.MethodGet, api+"/releases/latest", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", rsp.Status)
+	}
+
+	release := &githubRelease{}
+	return release, json.NewDecoder(rsp.Body).Decode(release)
+}
+
+// geoRelease 是某个 asset 的最新版本
+type geoRelease struct {
+	Source string
+	Asset  *geoAsset
+	Tag    string
+	URL    string
+}
+
+func resolveGeoReleases(client *http.Client, source *geoSource) ([]*geoRelease, error) {
+	releases := make(map[string]*githubRelease)
+	var result []*geoRelease
+	for _, asset := range source.Assets {
+		release, ok := releases[asset.API]
+		if !ok {
+			var err error
+			release, err = getLatestRelease(client, asset.API)
+			if err != nil {
+				return nil, fmt.Errorf("get latest release of %s err: %s", asset.API, err)
+			}
+			releases[asset.API] = release
+		}
+
+		var dl string
+		for _, a := range release.Assets {
+			if a.Name == asset.Name {
+				dl = a.BrowserDownloadURL
+				break
+			}
+		}
+		if dl == "" {
+			return nil, fmt.Errorf("asset %s not found in release %s", asset.Name, release.TagName)
+		}
+
+		result = append(result, &geoRelease{
+			Source: source.Name,
+			Asset:  asset,
+			Tag:    release.TagName,
+			URL:    source.Mirror + dl,
+		})
+	}
+	return result, nil
+}
+
+const (
+	geoManifestFile = "geo-manifest.json"
+)
+
+type geoManifestEntry struct {
+	Source      string    `json:"source"`
+	Tag         string    `json:"tag"`
+	URL         string    `json:"url"`
+	InstalledAt time.Time `json:"installed_at"`
+}
+
+// geoManifest 记录已安装的 geo 数据版本, 与数据文件保存在同一目录
+type geoManifest struct {
+	mu    sync.Mutex
+	path  string
+	Files map[string]*geoManifestEntry `json:"files"`
+}
+
+func loadGeoManifest(dir string) (*geoManifest, error) {
+	m := &geoManifest{
+		path:  filepath.Join(dir, geoManifestFile),
+		Files: make(map[string]*geoManifestEntry),
+	}
+
+	data, err := os.ReadFile(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	if m.Files == nil {
+		m.Files = make(map[string]*geoManifestEntry)
+	}
+	return m, nil
+}
+
+// UpToDate 判断本地文件是否已经是该版本
+func (m *geoManifest) UpToDate(r *geoRelease) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.Files[r.Asset.File]
+	if entry == nil || entry.Source != r.Source || entry.Tag != r.Tag {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(filepath.Dir(m.path), r.Asset.File))
+	return err == nil
+}
+
+func (m *geoManifest) Installed(r *geoRelease) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Files[r.Asset.File] = &geoManifestEntry{
+		Source:      r.Source,
+		Tag:         r.Tag,
+		URL:         r.URL,
+		InstalledAt: time.Now(),
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(m.path, data, 0644)
+}
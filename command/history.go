@@ -0,0 +1,182 @@
+package command
+
+import (
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var history = &cobra.Command{
+	Use:        "history [node]",
+	Aliases:    nil,
+	SuggestFor: nil,
+	Short:      "show latency and availability history of nodes",
+	Long: `example:
+  history                       summary of all nodes in the last 24h
+  history "HK 01" --since 168h --bucket 6h
+  history 3fa2c1                node id prefix, see the summary
+  history --prune 720h          delete samples older than 30 days
+
+ping and daemon save every result to $XDG_DATA_HOME/v2ray-bot/history.db,
+disable it with --history=false.`,
+	Example:                    "",
+	ValidArgs:                  nil,
+	ValidArgsFunction:          nil,
+	Args:                       cobra.MaximumNArgs(1),
+	ArgAliases:                 nil,
+	BashCompletionFunction:     "",
+	Deprecated:                 "",
+	Annotations:                nil,
+	Version:                    "",
+	PersistentPreRun:           nil,
+	PersistentPreRunE:          nil,
+	PreRun:                     nil,
+	PreRunE:                    nil,
+	Run:                        historyRun,
+	RunE:                       nil,
+	PostRun:                    nil,
+	PostRunE:                   nil,
+	PersistentPostRun:          nil,
+	PersistentPostRunE:         nil,
+	FParseErrWhitelist:         cobra.FParseErrWhitelist{},
+	CompletionOptions:          cobra.CompletionOptions{},
+	TraverseChildren:           false,
+	Hidden:                     false,
+	SilenceErrors:              false,
+	SilenceUsage:               false,
+	DisableFlagParsing:         false,
+	DisableAutoGenTag:          false,
+	DisableFlagsInUseLine:      false,
+	DisableSuggestions:         false,
+	SuggestionsMinimumDistance: 0,
+}
+
+var (
+	saveHistory     bool
+	nameSaveHistory = "history"
+
+	historySince     time.Duration
+	nameHistorySince = "since"
+
+	historyBucket     time.Duration
+	nameHistoryBucket = "bucket"
+
+	historyPrune     time.Duration
+	nameHistoryPrune = "prune"
+)
+
+func init() {
+	rootCmd.AddCommand(history)
+
+	history.Flags().
+		DurationVar(&historySince, nameHistorySince, 24*time.Hour, "only show samples in this period")
+
+	history.Flags().
+		DurationVar(&historyBucket, nameHistoryBucket, time.Hour, "aggregate samples of a node by this interval")
+
+	history.Flags().
+		DurationVar(&historyPrune, nameHistoryPrune, 0, "delete samples older than this and exit")
+}
+
+func historyRun(cmd *cobra.Command, args []string) {
+	h, err := openHistoryDB()
+	if err != nil {
+		cmd.PrintErrf("%s\n", err)
+		return
+	}
+	defer h.Close()
+
+	if historyPrune > 0 {
+		n, err := h.Prune(time.Now().Add(-historyPrune))
+		if err != nil {
+			cmd.PrintErrf("prune history err: %s\n", err)
+			return
+		}
+		cmd.Printf("%d samples deleted\n", n)
+		return
+	}
+
+	since := time.Now().Add(-historySince)
+	if len(args) == 0 {
+		printHistoryNodes(cmd, h, since)
+		return
+	}
+
+	nodes, err := h.FindNodes(args[0])
+	if err != nil {
+		cmd.PrintErrf("find node err: %s\n", err)
+		return
+	}
+	switch len(nodes) {
+	case 0:
+		cmd.PrintErrf("node not found: %s\n", args[0])
+		return
+	case 1:
+	default:
+		cmd.PrintErrf("%d nodes match %s, use the id:\n", len(nodes), args[0])
+		for _, n := range nodes {
+			cmd.PrintErrf("  %s %s (%s:%d)\n", n.ID, n.Name, n.Address, n.Port)
+		}
+		return
+	}
+	printHistoryTrend(cmd, h, nodes[0], since)
+}
+
+func formatDelay(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%dms", d.Milliseconds())
+}
+
+func printHistoryNodes(cmd *cobra.Command, h *historyDB, since time.Time) {
+	nodes, err := h.Nodes(since)
+	if err != nil {
+		cmd.PrintErrf("query history err: %s\n", err)
+		return
+	}
+	if len(nodes) == 0 {
+		cmd.Println("no history, run ping or daemon first")
+		return
+	}
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "ID\tNODE\tSAMPLES\tAVAIL\tAVG\tLAST OK")
+	for _, n := range nodes {
+		avail, lastOK := "-", "-"
+		if n.Samples > 0 {
+			avail = fmt.Sprintf("%.0f%%", n.Availability()*100)
+		}
+		if !n.LastOK.IsZero() {
+			lastOK = n.LastOK.Format("2006-01-02 15:04")
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n",
+			n.ID, n.Name, n.Samples, avail, formatDelay(n.AvgDelay), lastOK)
+	}
+	_ = w.Flush()
+}
+
+func printHistoryTrend(cmd *cobra.Command, h *historyDB, n *historyNode, since time.Time) {
+	buckets, err := h.Trend(n.ID, since, historyBucket)
+	if err != nil {
+		cmd.PrintErrf("query history err: %s\n", err)
+		return
+	}
+
+	cmd.Printf("%s %s (%s:%d)\n", n.ID, n.Name, n.Address, n.Port)
+	if len(buckets) == 0 {
+		cmd.Printf("no samples since %s\n", since.Format("2006-01-02 15:04"))
+		return
+	}
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "TIME\tSAMPLES\tAVAIL\tAVG\tMIN\tMAX")
+	for _, b := range buckets {
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%.0f%%\t%s\t%s\t%s\n",
+			b.Start.Format("2006-01-02 15:04"), b.Samples, float64(b.OK)/float64(b.Samples)*100,
+			formatDelay(b.AvgDelay), formatDelay(b.MinDelay), formatDelay(b.MaxDelay))
+	}
+	_ = w.Flush()
+}
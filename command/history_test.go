@@ -0,0 +1,85 @@
+package command
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), historyDBFile)
+	h, err := openHistoryDBFile(path)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer h.Close()
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("history db: %v, err: %v\n", info, err)
+	}
+
+	var (
+		a = &vmess{Ps: "a", Id: "2015cdb0-4f09-4796-7ec6-91b2e5dc2923", Add: "a.example.com", Port: 443}
+		b = &vmess{Ps: "b", Id: "2015cdb0-4f09-4796-7ec6-91b2e5dc2923", Add: "b.example.com", Port: 443}
+	)
+	base := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	if err := h.RecordSubscription("https://example.com/sub", []*vmess{a, b}, "", base); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	// a 每次都成功, b 只有第一次成功
+	for i := 0; i < 4; i++ {
+		at := base.Add(time.Duration(i) * 30 * time.Minute)
+		bErr := errors.New("timeout")
+		if i == 0 {
+			bErr = nil
+		}
+		stats := []pingStat{
+			{v: a, dur: time.Duration(100+i*100) * time.Millisecond},
+			{v: b, dur: 50 * time.Millisecond, err: bErr},
+		}
+		if err := h.RecordSamples(stats, "https://www.google.com/generate_204", at); err != nil {
+			t.Fatalf("%s\n", err)
+		}
+	}
+
+	nodes, err := h.Nodes(base)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if len(nodes) != 2 || nodes[0].Name != "a" || nodes[1].Name != "b" {
+		t.Fatalf("nodes: %+v\n", nodes)
+	}
+	if n := nodes[0]; n.Samples != 4 || n.OK != 4 || n.AvgDelay != 250*time.Millisecond || n.Source != "https://example.com/sub" {
+		t.Fatalf("node a: %+v\n", n)
+	}
+	if n := nodes[1]; n.Availability() != 0.25 || !n.LastOK.Equal(base) {
+		t.Fatalf("node b: %+v\n", n)
+	}
+
+	found, err := h.FindNodes(nodeID(b)[:6])
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if len(found) != 1 || found[0].Name != "b" {
+		t.Fatalf("found: %+v\n", found)
+	}
+
+	buckets, err := h.Trend(nodeID(a), base, time.Hour)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if len(buckets) != 2 || buckets[0].Samples != 2 || buckets[0].AvgDelay != 150*time.Millisecond ||
+		buckets[1].MinDelay != 300*time.Millisecond || buckets[1].MaxDelay != 400*time.Millisecond {
+		t.Fatalf("buckets: %+v %+v\n", buckets[0], buckets[1])
+	}
+
+	n, err := h.Prune(base.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if n != 4 {
+		t.Fatalf("pruned: %d\n", n)
+	}
+}
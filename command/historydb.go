@@ -0,0 +1,355 @@
+package command
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adrg/xdg"
+	"github.com/jdxj/v2ray-bot/logger"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	historyDBFile = "history.db"
+
+	// modernc.org/sqlite 注册的驱动名, 不需要 cgo
+	sqliteDriver = "sqlite"
+)
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS subscriptions (
+	url        TEXT PRIMARY KEY,
+	fetched_at INTEGER NOT NULL,
+	nodes      INTEGER NOT NULL,
+	error      TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS nodes (
+	id         TEXT PRIMARY KEY,
+	name       TEXT NOT NULL,
+	address    TEXT NOT NULL,
+	port       INTEGER NOT NULL,
+	net        TEXT NOT NULL,
+	source     TEXT NOT NULL DEFAULT '',
+	first_seen INTEGER NOT NULL,
+	last_seen  INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS samples (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	node_id    TEXT NOT NULL REFERENCES nodes(id),
+	probe_url  TEXT NOT NULL,
+	checked_at INTEGER NOT NULL,
+	delay_ms   INTEGER NOT NULL,
+	error      TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS samples_node_checked ON samples(node_id, checked_at);
+`
+
+// historyDB 在 sqlite 中保存订阅, 节点以及每一次测速的结果,
+// 时间都以 unix 毫秒保存
+type historyDB struct {
+	db *sql.DB
+}
+
+func openHistoryDB() (*historyDB, error) {
+	path, err := xdg.DataFile(filepath.Join(appName, historyDBFile))
+	if err != nil {
+		return nil, err
+	}
+	return openHistoryDBFile(path)
+}
+
+func openHistoryDBFile(path string) (*historyDB, error) {
+	// 订阅地址中有 token, 只允许自己读写, sqlite 的 -wal 和 -shm 文件使用相同的权限
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open history db err: %s", err)
+	}
+	_ = f.Close()
+	if err := os.Chmod(path, 0600); err != nil {
+		return nil, fmt.Errorf("open history db err: %s", err)
+	}
+
+	db, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		return nil, fmt.Errorf("open history db err: %s", err)
+	}
+	// daemon 和 ping 可能同时写入, 只用一个连接并等待锁
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{
+		"PRAGMA busy_timeout = 5000",
+		"PRAGMA journal_mode = WAL",
+		historySchema,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("init history db err: %s", err)
+		}
+	}
+	return &historyDB{db: db}, nil
+}
+
+func (h *historyDB) Close() error {
+	return h.db.Close()
+}
+
+// upsertNodes 记录节点, 已存在的节点更新名字和最后出现的时间
+func upsertNodes(tx *sql.Tx, vmesses []*vmess, source string, at time.Time) error {
+	stmt, err := tx.Prepare(`
+INSERT INTO nodes (id, name, address, port, net, source, first_seen, last_seen)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(id) DO UPDATE SET
+	name = excluded.name,
+	source = CASE WHEN excluded.source = '' THEN nodes.source ELSE excluded.source END,
+	last_seen = excluded.last_seen`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	ms := at.UnixMilli()
+	for _, v := range vmesses {
+		_, err := stmt.Exec(nodeID(v), v.Ps, v.Add, v.Port, v.Net, source, ms, ms)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *historyDB) inTx(f func(tx *sql.Tx) error) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecordSubscription 记录一次订阅的拉取结果以及其中的节点, fetchErr 为空表示成功
+func (h *historyDB) RecordSubscription(url string, vmesses []*vmess, fetchErr string, at time.Time) error {
+	return h.inTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+INSERT INTO subscriptions (url, fetched_at, nodes, error) VALUES (?, ?, ?, ?)
+ON CONFLICT(url) DO UPDATE SET
+	fetched_at = excluded.fetched_at,
+	nodes = excluded.nodes,
+	error = excluded.error`,
+			url, at.UnixMilli(), len(vmesses), fetchErr)
+		if err != nil {
+			return err
+		}
+		return upsertNodes(tx, vmesses, url, at)
+	})
+}
+
+// RecordSamples 记录一轮测速的结果
+func (h *historyDB) RecordSamples(stats []pingStat, probeURL string, at time.Time) error {
+	vmesses := make([]*vmess, 0, len(stats))
+	for _, s := range stats {
+		vmesses = append(vmesses, s.v)
+	}
+	return h.inTx(func(tx *sql.Tx) error {
+		if err := upsertNodes(tx, vmesses, "", at); err != nil {
+			return err
+		}
+		stmt, err := tx.Prepare(`
+INSERT INTO samples (node_id, probe_url, checked_at, delay_ms, error) VALUES (?, ?, ?, ?, ?)`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		ms := at.UnixMilli()
+		for _, s := range stats {
+			delay, errMsg := s.dur.Milliseconds(), ""
+			if s.err != nil {
+				delay, errMsg = 0, s.err.Error()
+			}
+			if _, err := stmt.Exec(nodeID(s.v), probeURL, ms, delay, errMsg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type historyNode struct {
+	ID       string
+	Name     string
+	Address  string
+	Port     uint32
+	Source   string
+	LastSeen time.Time
+
+	// 统计区间内的测速结果
+	Samples  int
+	OK       int
+	AvgDelay time.Duration
+	LastOK   time.Time
+}
+
+// Availability 返回成功的比例, 没有测速结果时为 0
+func (n *historyNode) Availability() float64 {
+	if n.Samples == 0 {
+		return 0
+	}
+	return float64(n.OK) / float64(n.Samples)
+}
+
+// Nodes 返回 since 之后的节点统计, 按可用率和平均延迟排序
+func (h *historyDB) Nodes(since time.Time) ([]*historyNode, error) {
+	rows, err := h.db.Query(`
+SELECT n.id, n.name, n.address, n.port, n.source, n.last_seen,
+	COUNT(s.id),
+	COALESCE(SUM(s.error = ''), 0),
+	COALESCE(AVG(CASE WHEN s.error = '' THEN s.delay_ms END), 0),
+	COALESCE(MAX(CASE WHEN s.error = '' THEN s.checked_at END), 0)
+FROM nodes n
+LEFT JOIN samples s ON s.node_id = n.id AND s.checked_at >= ?
+GROUP BY n.id
+ORDER BY n.name`, since.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nodes []*historyNode
+	for rows.Next() {
+		var (
+			n              = &historyNode{}
+			lastSeen, last int64
+			avg            float64
+		)
+		err := rows.Scan(&n.ID, &n.Name, &n.Address, &n.Port, &n.Source, &lastSeen,
+			&n.Samples, &n.OK, &avg, &last)
+		if err != nil {
+			return nil, err
+		}
+		n.LastSeen = time.UnixMilli(lastSeen)
+		n.AvgDelay = time.Duration(avg * float64(time.Millisecond))
+		if last > 0 {
+			n.LastOK = time.UnixMilli(last)
+		}
+		nodes = append(nodes, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if ai, aj := nodes[i].Availability(), nodes[j].Availability(); ai != aj {
+			return ai > aj
+		}
+		return nodes[i].OK > 0 && nodes[i].AvgDelay < nodes[j].AvgDelay
+	})
+	return nodes, nil
+}
+
+// FindNodes 按 id 前缀或名字查找节点, 名字完全相同的优先
+func (h *historyDB) FindNodes(query string) ([]*historyNode, error) {
+	nodes, err := h.Nodes(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	var exact, matched []*historyNode
+	for _, n := range nodes {
+		switch {
+		case n.Name == query || n.ID == query:
+			exact = append(exact, n)
+		case strings.HasPrefix(n.ID, query), strings.Contains(strings.ToLower(n.Name), strings.ToLower(query)):
+			matched = append(matched, n)
+		}
+	}
+	if len(exact) > 0 {
+		return exact, nil
+	}
+	return matched, nil
+}
+
+type trendBucket struct {
+	Start    time.Time
+	Samples  int
+	OK       int
+	AvgDelay time.Duration
+	MinDelay time.Duration
+	MaxDelay time.Duration
+}
+
+// Trend 把节点在 since 之后的测速结果按 bucket 聚合, 按时间排序
+func (h *historyDB) Trend(id string, since time.Time, bucket time.Duration) ([]*trendBucket, error) {
+	size := bucket.Milliseconds()
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid bucket: %s", bucket)
+	}
+	rows, err := h.db.Query(`
+SELECT checked_at / ? * ? AS start,
+	COUNT(*),
+	SUM(error = ''),
+	COALESCE(AVG(CASE WHEN error = '' THEN delay_ms END), 0),
+	COALESCE(MIN(CASE WHEN error = '' THEN delay_ms END), 0),
+	COALESCE(MAX(CASE WHEN error = '' THEN delay_ms END), 0)
+FROM samples
+WHERE node_id = ? AND checked_at >= ?
+GROUP BY start
+ORDER BY start`, size, size, id, since.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []*trendBucket
+	for rows.Next() {
+		var (
+			b            = &trendBucket{}
+			start        int64
+			avg          float64
+			minMs, maxMs int64
+		)
+		if err := rows.Scan(&start, &b.Samples, &b.OK, &avg, &minMs, &maxMs); err != nil {
+			return nil, err
+		}
+		b.Start = time.UnixMilli(start)
+		b.AvgDelay = time.Duration(avg * float64(time.Millisecond))
+		b.MinDelay = time.Duration(minMs) * time.Millisecond
+		b.MaxDelay = time.Duration(maxMs) * time.Millisecond
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// Prune 删除 before 之前的测速结果, 返回删除的条数
+func (h *historyDB) Prune(before time.Time) (int64, error) {
+	rs, err := h.db.Exec("DELETE FROM samples WHERE checked_at < ?", before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return rs.RowsAffected()
+}
+
+// recordHistory 保存测速结果, 历史记录不影响命令本身, 失败时只输出错误
+func recordHistory(f func(h *historyDB) error) {
+	if !saveHistory {
+		return
+	}
+	h, err := openHistoryDB()
+	if err != nil {
+		logger.Errorw("open history db failed", "err", err)
+		return
+	}
+	defer h.Close()
+
+	if err := f(h); err != nil {
+		logger.Errorw("save history failed", "err", err)
+	}
+}
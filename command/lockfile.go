@@ -0,0 +1,43 @@
+package command
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// lockFile 对 path 加排他的建议锁, daemon, serve 和 bot 是不同的进程,
+// 读改写同一个文件时需要用它串行化. 返回的函数释放锁
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := flock(f); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return func() {
+		_ = funlock(f)
+		_ = f.Close()
+	}, nil
+}
+
+// writeFileAtomic 先写入同目录下的临时文件再重命名, 读取方不会看到写了一半的文件,
+// 临时文件的权限为 0600
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
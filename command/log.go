@@ -0,0 +1,75 @@
+package command
+
+import (
+	"fmt"
+
+	"github.com/jdxj/v2ray-bot/logger"
+	"github.com/v2fly/v2ray-core/v5/app/log"
+	"github.com/v2fly/v2ray-core/v5/common"
+	comLog "github.com/v2fly/v2ray-core/v5/common/log"
+	"github.com/v2fly/v2ray-core/v5/common/serial"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	logLevel     string
+	nameLogLevel = "log-level"
+
+	logFormat     string
+	nameLogFormat = "log-format"
+)
+
+func init() {
+	rootCmd.PersistentFlags().
+		StringVar(&logLevel, nameLogLevel, "info", "log level: debug, info, warn or error")
+
+	rootCmd.PersistentFlags().
+		StringVar(&logFormat, nameLogFormat, logger.FormatConsole, "log format: console or json")
+
+	// v2ray-core 的错误日志也输出到 logger
+	common.Must(log.RegisterHandlerCreator(log.LogType_Console,
+		func(log.LogType, log.HandlerCreatorOptions) (comLog.Handler, error) {
+			return &v2rayLogHandler{}, nil
+		}))
+}
+
+// nodeLogger 返回带有节点字段的 logger
+func nodeLogger(tag string, v *vmess) *zap.SugaredLogger {
+	return logger.With("node", v.Ps, "tag", tag, "address", fmt.Sprintf("%s:%d", v.Add, v.Port))
+}
+
+type v2rayLogHandler struct{}
+
+func (h *v2rayLogHandler) Handle(msg comLog.Message) {
+	l := logger.Named("v2ray")
+	m, ok := msg.(*comLog.GeneralMessage)
+	if !ok {
+		l.Debug(msg.String())
+		return
+	}
+
+	content := serial.ToString(m.Content)
+	switch m.Severity {
+	case comLog.Severity_Error:
+		l.Error(content)
+	case comLog.Severity_Warning:
+		l.Warn(content)
+	case comLog.Severity_Info:
+		l.Info(content)
+	default:
+		l.Debug(content)
+	}
+}
+
+// v2raySeverity 返回 v2ray-core 错误日志的级别, 它的 info 日志每个连接都会输出,
+// 所以只有 debug 时才输出 info 及以下的日志
+func v2raySeverity() comLog.Severity {
+	switch logger.Level() {
+	case zapcore.DebugLevel:
+		return comLog.Severity_Debug
+	case zapcore.InfoLevel, zapcore.WarnLevel:
+		return comLog.Severity_Warning
+	}
+	return comLog.Severity_Error
+}
@@ -0,0 +1,46 @@
+package command
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jdxj/v2ray-bot/logger"
+	"github.com/v2fly/v2ray-core/v5/app/router"
+	comLog "github.com/v2fly/v2ray-core/v5/common/log"
+)
+
+func TestV2rayLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger.SetOutput(buf)
+	defer logger.SetOutput(os.Stderr)
+	if err := logger.Init("debug", logger.FormatJSON); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer func() { _ = logger.Init("info", logger.FormatConsole) }()
+
+	ins, err := startV2ray(newV2rayConfig(nil, &router.Config{}))
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	comLog.Record(&comLog.GeneralMessage{
+		Severity: comLog.Severity_Warning,
+		Content:  "dial https://sub.example.com/api?token=secret failed",
+	})
+	_ = ins.Close()
+
+	out := buf.String()
+	if !strings.Contains(out, `"logger":"v2ray"`) || !strings.Contains(out, `"level":"warn"`) {
+		t.Fatalf("v2ray log not routed: %s\n", out)
+	}
+	if strings.Contains(out, "secret") {
+		t.Fatalf("not redacted: %s\n", out)
+	}
+
+	buf.Reset()
+	nodeLogger("node-0", &vmess{Ps: "a", Add: "a.example.com", Port: 443}).Debugw("ping done")
+	if out := buf.String(); !strings.Contains(out, `"tag":"node-0"`) || !strings.Contains(out, `"address":"a.example.com:443"`) {
+		t.Fatalf("node fields missing: %s\n", out)
+	}
+}
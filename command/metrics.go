@@ -0,0 +1,272 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jdxj/v2ray-bot/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "v2raybot"
+
+	// 节点成功率统计最近多少次测速
+	successWindow = 20
+)
+
+var nodeLabels = []string{"node", "protocol", "source"}
+
+// nodeRecord 保存节点最近的测速结果, 用于计算成功率
+type nodeRecord struct {
+	results     []bool
+	lastSuccess time.Time
+}
+
+func (r *nodeRecord) add(ok bool, at time.Time) {
+	r.results = append(r.results, ok)
+	if len(r.results) > successWindow {
+		r.results = r.results[len(r.results)-successWindow:]
+	}
+	if ok {
+		r.lastSuccess = at
+	}
+}
+
+func (r *nodeRecord) ratio() float64 {
+	ok := 0
+	for _, v := range r.results {
+		if v {
+			ok++
+		}
+	}
+	return float64(ok) / float64(len(r.results))
+}
+
+// daemonMetrics 把 daemon 的状态导出为 prometheus 指标,
+// gauge 在每次抓取时从状态文件同步, 所以 serve 也能导出 daemon 的结果,
+// 直方图, 测速次数和成功率只统计本进程产生的排名
+type daemonMetrics struct {
+	state *daemonState
+	reg   *prometheus.Registry
+
+	mu      sync.Mutex
+	records map[string]*nodeRecord
+
+	latency     *prometheus.GaugeVec
+	latencyHist *prometheus.HistogramVec
+	up          *prometheus.GaugeVec
+	ratio       *prometheus.GaugeVec
+	lastSuccess *prometheus.GaugeVec
+	probes      *prometheus.CounterVec
+	rankedAt    prometheus.Gauge
+
+	subUp      *prometheus.GaugeVec
+	subFetched *prometheus.GaugeVec
+	subNodes   *prometheus.GaugeVec
+	nodes      prometheus.Gauge
+}
+
+func newDaemonMetrics(state *daemonState) *daemonMetrics {
+	m := &daemonMetrics{
+		state:   state,
+		reg:     prometheus.NewRegistry(),
+		records: make(map[string]*nodeRecord),
+		latency: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "node_latency_seconds",
+			Help:      "Latency of the latest successful probe.",
+		}, nodeLabels),
+		latencyHist: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "node_probe_duration_seconds",
+			Help:      "Latency of successful probes.",
+			Buckets:   []float64{.05, .1, .2, .3, .5, .75, 1, 1.5, 2, 3, 5, 10},
+		}, nodeLabels),
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "node_up",
+			Help:      "Whether the latest probe succeeded.",
+		}, nodeLabels),
+		ratio: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "node_success_ratio",
+			Help:      "Ratio of successful probes in the recent rankings.",
+		}, nodeLabels),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "node_last_success_timestamp_seconds",
+			Help:      "Unix time of the latest successful probe.",
+		}, nodeLabels),
+		probes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "node_probes_total",
+			Help:      "Number of probes by result.",
+		}, append(nodeLabels, "result")),
+		rankedAt: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "ranking_timestamp_seconds",
+			Help:      "Unix time of the latest ranking.",
+		}),
+		subUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "subscription_up",
+			Help:      "Whether the latest fetch of the subscription succeeded.",
+		}, []string{"source"}),
+		subFetched: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "subscription_last_fetch_timestamp_seconds",
+			Help:      "Unix time of the latest fetch of the subscription.",
+		}, []string{"source"}),
+		subNodes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "subscription_nodes",
+			Help:      "Number of valid nodes in the subscription.",
+		}, []string{"source"}),
+		nodes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "nodes",
+			Help:      "Number of valid nodes of all subscriptions.",
+		}),
+	}
+	m.reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.latency, m.latencyHist, m.up, m.ratio, m.lastSuccess, m.probes, m.rankedAt,
+		m.subUp, m.subFetched, m.subNodes, m.nodes,
+	)
+	return m
+}
+
+// sourceLabel 只保留订阅的域名, 订阅地址中通常带有 token
+func sourceLabel(u string) string {
+	if u == "" {
+		return ""
+	}
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Host == "" {
+		return "invalid"
+	}
+	return parsed.Host
+}
+
+// sync 从状态文件读取订阅和最新排名的结果, 只更新 gauge
+func (m *daemonMetrics) sync() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.state.view(func() {
+		m.subUp.Reset()
+		m.subFetched.Reset()
+		m.subNodes.Reset()
+		for u, st := range m.state.Subscriptions {
+			source := sourceLabel(u)
+			up := 1.0
+			if st.Error != "" {
+				up = 0
+			}
+			m.subUp.WithLabelValues(source).Set(up)
+			m.subFetched.WithLabelValues(source).Set(float64(st.FetchedAt.Unix()))
+			m.subNodes.WithLabelValues(source).Set(float64(st.Nodes))
+		}
+		m.nodes.Set(float64(len(m.state.Nodes)))
+
+		// 只导出当前排名中的节点, 已删除的节点不再出现
+		m.latency.Reset()
+		m.up.Reset()
+		ranking := m.state.Ranking
+		if ranking == nil {
+			return
+		}
+		m.rankedAt.Set(float64(ranking.CheckedAt.Unix()))
+		for _, r := range ranking.Results {
+			labels := rankingLabels(r)
+			if r.Error != "" {
+				m.up.With(labels).Set(0)
+				continue
+			}
+			m.latency.With(labels).Set((time.Duration(r.DelayMs) * time.Millisecond).Seconds())
+			m.up.With(labels).Set(1)
+		}
+	})
+}
+
+func rankingLabels(r *rankingResult) prometheus.Labels {
+	return prometheus.Labels{"node": r.Node, "protocol": "vmess", "source": sourceLabel(r.Source)}
+}
+
+// ObserveRanking 在产生排名时调用, 每个排名都计入直方图, 测速次数和成功率,
+// 不受抓取间隔的影响. m 为 nil 时不做任何事
+func (m *daemonMetrics) ObserveRanking(ranking *rankingState) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ratio.Reset()
+	m.lastSuccess.Reset()
+	records := make(map[string]*nodeRecord, len(ranking.Results))
+	for _, r := range ranking.Results {
+		labels := rankingLabels(r)
+		record := m.records[r.ID]
+		if record == nil {
+			record = &nodeRecord{}
+		}
+		records[r.ID] = record
+
+		ok := r.Error == ""
+		record.add(ok, ranking.CheckedAt)
+		result := "failure"
+		if ok {
+			result = "success"
+			m.latencyHist.With(labels).Observe((time.Duration(r.DelayMs) * time.Millisecond).Seconds())
+		}
+		m.probes.MustCurryWith(labels).WithLabelValues(result).Inc()
+		m.ratio.With(labels).Set(record.ratio())
+		if !record.lastSuccess.IsZero() {
+			m.lastSuccess.With(labels).Set(float64(record.lastSuccess.Unix()))
+		}
+	}
+	m.records = records
+}
+
+// Handler 在每次抓取前同步状态
+func (m *daemonMetrics) Handler() http.Handler {
+	h := promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := m.sync(); err != nil {
+			http.Error(w, "sync daemon state err: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serveMetrics 在 addr 上提供 /metrics, ctx 结束时关闭
+func serveMetrics(ctx context.Context, addr string, m *daemonMetrics) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	logger.Infow("serving metrics", "url", "http://"+addr+"/metrics")
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Errorw("serve metrics failed", "err", err)
+	}
+}
@@ -0,0 +1,70 @@
+package command
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDaemonMetrics(t *testing.T) {
+	setXDGDir(t, "XDG_DATA_HOME", t.TempDir())
+
+	state, err := loadDaemonState()
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	m := newDaemonMetrics(state)
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		data, _ := io.ReadAll(w.Result().Body)
+		return string(data)
+	}
+
+	const sub = "https://sub.example.com/api?token=secret"
+	checkedAt := time.Now()
+	rank := func(bErr string) {
+		checkedAt = checkedAt.Add(time.Minute)
+		ranking := &rankingState{CheckedAt: checkedAt, Results: []*rankingResult{
+			{ID: "a", Node: "a", Source: sub, DelayMs: 120},
+			{ID: "b", Node: "b", Source: sub, Error: bErr},
+		}}
+		err := state.update(func() {
+			state.Subscriptions = map[string]*subscriptionState{
+				sub: {FetchedAt: checkedAt, Nodes: 2},
+			}
+			state.Ranking = ranking
+		})
+		if err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		m.ObserveRanking(ranking)
+	}
+
+	// 两次抓取之间的排名都会统计, 同一个排名只统计一次
+	rank("")
+	rank("timeout")
+	scrape()
+	out := scrape()
+
+	for _, want := range []string{
+		`v2raybot_node_latency_seconds{node="a",protocol="vmess",source="sub.example.com"} 0.12`,
+		`v2raybot_node_up{node="b",protocol="vmess",source="sub.example.com"} 0`,
+		`v2raybot_node_success_ratio{node="b",protocol="vmess",source="sub.example.com"} 0.5`,
+		`v2raybot_node_probes_total{node="a",protocol="vmess",result="success",source="sub.example.com"} 2`,
+		`v2raybot_node_probe_duration_seconds_count{node="a",protocol="vmess",source="sub.example.com"} 2`,
+		`v2raybot_subscription_nodes{source="sub.example.com"} 2`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %s in:\n%s\n", want, out)
+		}
+	}
+	if strings.Contains(out, "secret") {
+		t.Fatalf("subscription token is exported\n")
+	}
+	if strings.Contains(out, `v2raybot_node_latency_seconds{node="b"`) {
+		t.Fatalf("latency of a failed node is exported\n")
+	}
+}
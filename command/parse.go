@@ -2,14 +2,18 @@ package command
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
-	"net/http"
+	"net"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/jdxj/v2ray-bot/logger"
 	"github.com/spf13/cobra"
 )
 
@@ -57,6 +61,15 @@ var (
 
 	fromURL     string
 	nameFromURL = "from-url"
+
+	resolve     bool
+	nameResolve = "resolve"
+
+	geoIP     string
+	nameGeoIP = "geoip"
+
+	exportFormat     string
+	nameExportFormat = "format"
 )
 
 func init() {
@@ -69,6 +82,15 @@ func init() {
 		StringVar(&fromURL, nameFromURL, "", "parse v2ray share from subscription url")
 
 	parse.MarkFlagsMutuallyExclusive(nameFromFile, nameFromURL)
+
+	parse.Flags().
+		BoolVar(&resolve, nameResolve, false, "resolve node address and look up its country")
+
+	parse.Flags().
+		StringVar(&geoIP, nameGeoIP, geoIpFile, "geoip.dat used by --resolve")
+
+	parse.Flags().
+		StringVar(&exportFormat, nameExportFormat, formatJSON, "output format: json, share, clash or singbox")
 }
 
 func parseRun(cmd *cobra.Command, args []string) {
@@ -78,6 +100,10 @@ func parseRun(cmd *cobra.Command, args []string) {
 		return
 	}
 
+	if resolve {
+		annotateVmess(vmesses)
+	}
+
 	err = exportVmess(cmd, vmesses)
 	if err != nil {
 		cmd.PrintErrf("export vmess err: %s", err)
@@ -85,11 +111,19 @@ func parseRun(cmd *cobra.Command, args []string) {
 }
 
 func tryParseVmess() ([]*vmess, error) {
-	if fromURL != "" {
-		return parseFromURL(fromURL)
-	} else {
+	if fromURL == "" {
 		return parseFromFile(fromFile)
 	}
+
+	vmesses, sub, err := parseFromURL(fromURL)
+	if err != nil {
+		return nil, err
+	}
+	if sub.Stale {
+		logger.Warnw("fetch subscription failed, using cached copy",
+			"url", fromURL, "err", sub.Err, "age", sub.Age())
+	}
+	return vmesses, nil
 }
 
 func exportVmess(cmd *cobra.Command, vmesses []*vmess) error {
@@ -109,8 +143,19 @@ func exportVmess(cmd *cobra.Command, vmesses []*vmess) error {
 		writer = f
 	}
 
-	encoder := json.NewEncoder(writer)
-	return encoder.Encode(vmesses)
+	e, err := findExporter(exportFormat)
+	if err != nil {
+		return err
+	}
+	data, warnings, err := e.export(vmesses)
+	for _, w := range warnings {
+		logger.Warnw(w, "format", exportFormat)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	return err
 }
 
 func parseFromFile(filename string) ([]*vmess, error) {
@@ -123,14 +168,14 @@ func parseFromFile(filename string) ([]*vmess, error) {
 	return parseFromReader(f)
 }
 
-func parseFromURL(url string) ([]*vmess, error) {
-	rsp, err := http.Get(url)
+func parseFromURL(url string) ([]*vmess, *subscription, error) {
+	sub, err := fetchSubscription(url)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer rsp.Body.Close()
 
-	return parseFromReader(rsp.Body)
+	vmesses, err := parseFromReader(bytes.NewReader(sub.Body))
+	return vmesses, sub, err
 }
 
 func parseFromReader(r io.Reader) ([]*vmess, error) {
@@ -177,6 +222,37 @@ type vmess struct {
 	Path string `json:"path"`
 	// 底层传输安全(tls)
 	Tls string `json:"tls"`
+
+	// 解析后的地址, 非分享链接字段
+	IPs []string `json:"-"`
+	// 地址所属国家代码, 非分享链接字段
+	Country string `json:"-"`
+}
+
+// annotatedVmess 是 json 格式输出的节点, 带有 parse --resolve 的标注,
+// 分享链接中没有这些字段
+type annotatedVmess struct {
+	vmess
+	IPs     []string `json:"ips,omitempty"`
+	Country string   `json:"country,omitempty"`
+}
+
+func annotated(vmesses []*vmess) []*annotatedVmess {
+	result := make([]*annotatedVmess, 0, len(vmesses))
+	for _, v := range vmesses {
+		result = append(result, &annotatedVmess{vmess: *v, IPs: v.IPs, Country: v.Country})
+	}
+	return result
+}
+
+func unannotated(avs []*annotatedVmess) []*vmess {
+	result := make([]*vmess, 0, len(avs))
+	for _, av := range avs {
+		v := av.vmess
+		v.IPs, v.Country = av.IPs, av.Country
+		result = append(result, &v)
+	}
+	return result
 }
 
 func (v *vmess) Encode() []byte {
@@ -184,6 +260,54 @@ func (v *vmess) Encode() []byte {
 	return data
 }
 
+// ShareLink 返回 vmess:// 分享链接
+func (v *vmess) ShareLink() string {
+	return "vmess://" + base64.StdEncoding.EncodeToString(v.Encode())
+}
+
+// annotateVmess 解析节点地址, 并根据 geoip.dat 标注国家
+func annotateVmess(vmesses []*vmess) {
+	db, err := loadGeoIPDB(geoIP)
+	if err != nil {
+		logger.Warnw("load geoip failed, skip country lookup", "file", geoIP, "err", err)
+	}
+
+	for _, v := range vmesses {
+		ips, err := resolveAddress(v.Add)
+		if err != nil {
+			logger.Warnw("resolve address failed", "node", v.Ps, "address", v.Add, "err", err)
+			continue
+		}
+
+		v.IPs = v.IPs[:0]
+		for _, ip := range ips {
+			v.IPs = append(v.IPs, ip.String())
+		}
+		if db != nil && len(ips) > 0 {
+			v.Country = db.Country(ips[0])
+		}
+	}
+}
+
+func resolveAddress(address string) ([]net.IP, error) {
+	if ip := net.ParseIP(address); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
 func parseVmess(share string) (*vmess, error) {
 	data := strings.TrimPrefix(share, "vmess://")
 	jsonData, err := base64.StdEncoding.DecodeString(data)
@@ -0,0 +1,90 @@
+package command
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestResolveAddress(t *testing.T) {
+	ips, err := resolveAddress("1.0.1.1")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("1.0.1.1")) {
+		t.Fatalf("ips: %v\n", ips)
+	}
+
+	ips, err = resolveAddress("localhost")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if len(ips) == 0 || !ips[0].IsLoopback() {
+		t.Fatalf("ips: %v\n", ips)
+	}
+
+	if _, err := resolveAddress("nonexistent.invalid"); err == nil {
+		t.Fatalf("want err for nonexistent.invalid\n")
+	}
+}
+
+func TestAnnotateVmess(t *testing.T) {
+	data, err := proto.Marshal(&routercommon.GeoIPList{
+		Entry: []*routercommon.GeoIP{
+			{
+				CountryCode: "CN",
+				Cidr:        []*routercommon.CIDR{{Ip: net.ParseIP("1.0.1.0").To4(), Prefix: 24}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	geoIP = filepath.Join(t.TempDir(), "geoip.dat")
+	defer func() { geoIP = geoIpFile }()
+	if err := os.WriteFile(geoIP, data, 0644); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	vmesses := []*vmess{
+		{Ps: "cn", Add: "1.0.1.1", Port: 443},
+		{Ps: "bad", Add: "nonexistent.invalid", Port: 443},
+	}
+	annotateVmess(vmesses)
+	if !reflect.DeepEqual(vmesses[0].IPs, []string{"1.0.1.1"}) || vmesses[0].Country != "cn" {
+		t.Fatalf("annotated: %+v\n", vmesses[0])
+	}
+	if len(vmesses[1].IPs) != 0 || vmesses[1].Country != "" {
+		t.Fatalf("annotated: %+v\n", vmesses[1])
+	}
+
+	// 标注只出现在 json 格式中, 不出现在分享链接中
+	if share := string(vmesses[0].Encode()); strings.Contains(share, "ips") || strings.Contains(share, "country") {
+		t.Fatalf("share has annotations: %s\n", share)
+	}
+	data, _, err = exportJSON(vmesses)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if !bytes.Contains(data, []byte(`"country":"cn"`)) {
+		t.Fatalf("json has no annotations: %s\n", data)
+	}
+	file := filepath.Join(t.TempDir(), "vmess.txt")
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	read, err := readVmessFile(file)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if !reflect.DeepEqual(read[0], vmesses[0]) {
+		t.Fatalf("read: %+v, want: %+v\n", read[0], vmesses[0])
+	}
+}
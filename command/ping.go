@@ -9,6 +9,8 @@ import (
 	"net/url"
 	"os"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -23,6 +25,7 @@ import (
 	"github.com/v2fly/v2ray-core/v5/common/net"
 	"github.com/v2fly/v2ray-core/v5/common/protocol"
 	"github.com/v2fly/v2ray-core/v5/common/serial"
+	"github.com/v2fly/v2ray-core/v5/common/session"
 	"github.com/v2fly/v2ray-core/v5/features/outbound"
 	coreProxyHttp "github.com/v2fly/v2ray-core/v5/proxy/http"
 	coreProxyVmess "github.com/v2fly/v2ray-core/v5/proxy/vmess"
@@ -38,12 +41,16 @@ var ping = &cobra.Command{
 	Aliases:    nil,
 	SuggestFor: nil,
 	Short:      "http ping",
-	Long: `example:
-  ping https://www.google.com --vmess-file vmess.txt`,
+	Long: `ping the url given as argument, or --probe-url (also read from the
+config file) when it's omitted.
+
+example:
+  ping https://www.google.com --vmess-file vmess.txt
+  ping --vmess-file vmess.txt`,
 	Example:                    "",
 	ValidArgs:                  nil,
 	ValidArgsFunction:          nil,
-	Args:                       cobra.MinimumNArgs(1),
+	Args:                       cobra.MaximumNArgs(1),
 	ArgAliases:                 nil,
 	BashCompletionFunction:     "",
 	Deprecated:                 "",
@@ -78,6 +85,22 @@ var (
 
 	vmessFile     string
 	nameVmessFile = "vmess-file"
+
+	groupBy        string
+	nameGroupBy    = "group-by"
+	groupByCountry = "country"
+
+	pingTimeout     time.Duration
+	namePingTimeout = "timeout"
+
+	listenAddr string
+	nameListen = "listen"
+
+	proxyUsername     string
+	nameProxyUsername = "username"
+
+	proxyPassword     string
+	nameProxyPassword = "password"
 )
 
 func init() {
@@ -86,58 +109,190 @@ func init() {
 	ping.Flags().
 		Uint32Var(&inboundPort, nameInboundPort, 7891, "port for v2ray http inbound")
 
+	ping.Flags().
+		StringVar(&listenAddr, nameListen, "127.0.0.1", "listen address for v2ray inbounds")
+
 	ping.Flags().
 		StringVar(&vmessFile, nameVmessFile, "vmess.txt", "parsed vmess config (parse cmd)")
+
+	ping.Flags().
+		StringVar(&groupBy, nameGroupBy, "", "group results, supported: country")
+
+	ping.Flags().
+		StringVar(&probeURL, nameProbeURL, "https://www.google.com/generate_204", "url to ping when no argument is given")
+
+	ping.Flags().
+		DurationVar(&pingTimeout, namePingTimeout, 10*time.Second, "timeout of each ping")
+
+	ping.Flags().
+		BoolVar(&saveHistory, nameSaveHistory, true, "save results to the history database (history cmd)")
 }
 
 func getHttpClient() *http.Client {
+	proxy := &url.URL{
+		Scheme: "http",
+		Host:   net.TCPDestination(net.ParseAddress(localAddress(listenAddr)), net.Port(inboundPort)).NetAddr(),
+	}
+	if proxyUsername != "" {
+		proxy.User = url.UserPassword(proxyUsername, proxyPassword)
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxy),
+		},
+	}
+}
+
+// newTaggedClient 返回经由指定出站发出请求的 http client, 不需要经过入站端口
+func newTaggedClient(ins *core.Instance, tag string, timeout time.Duration) *http.Client {
 	return &http.Client{
+		Timeout: timeout,
 		Transport: &http.Transport{
-			Proxy: func(r *http.Request) (*url.URL, error) {
-				return url.Parse(fmt.Sprintf("http://127.0.0.1:%d", inboundPort))
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dest, err := net.ParseDestination(network + ":" + addr)
+				if err != nil {
+					return nil, err
+				}
+				ctx = session.SetForcedOutboundTagToContext(ctx, tag)
+				return core.Dial(ctx, ins, dest)
 			},
+			DisableKeepAlives: true,
 		},
 	}
 }
 
+// probeOutbounds 并发地经由每个节点的出站请求 probeURL, tags 与 vmesses 一一对应,
+// 结果的顺序与 vmesses 一致
+func probeOutbounds(ins *core.Instance, vmesses []*vmess, tags []string, probeURL string) []pingStat {
+	pingStats := make([]pingStat, len(vmesses))
+	sem := make(chan struct{}, 8)
+	wg := sync.WaitGroup{}
+	for i := range vmesses {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			dur, err := tryPing(newTaggedClient(ins, tags[i], pingTimeout), probeURL)
+			l := nodeLogger(tags[i], vmesses[i])
+			if err != nil {
+				l.Debugw("ping failed", "url", probeURL, "err", err)
+			} else {
+				l.Debugw("ping done", "url", probeURL, "delay", dur)
+			}
+			pingStats[i] = pingStat{
+				v:   vmesses[i],
+				tag: tags[i],
+				dur: dur,
+				err: err,
+			}
+		}(i)
+	}
+	wg.Wait()
+	return pingStats
+}
+
+// pingVmesses 启动一个只有出站的 v2ray 实例并发测试所有节点, 结果按延迟排序,
+// 无法构建出站的节点不参与测试
+func pingVmesses(vmesses []*vmess, probeURL string) ([]pingStat, error) {
+	if len(vmesses) == 0 {
+		return nil, fmt.Errorf("no node")
+	}
+	vmesses = filterSupportedVmess(vmesses)
+	if len(vmesses) == 0 {
+		return nil, fmt.Errorf("no node supported by ping")
+	}
+
+	cfg := newV2rayConfig(nil, &router.Config{})
+	for i, v := range vmesses {
+		cfg.Outbound = append(cfg.Outbound, newOutboundConfig(probeTag(i), v))
+	}
+	ins, err := startV2ray(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer ins.Close()
+
+	stats := probeOutbounds(ins, vmesses, probeTags(vmesses), probeURL)
+	sortPingStats(stats)
+	return stats, nil
+}
+
 func getVmessFromFile() ([]*vmess, error) {
-	f, err := os.Open(vmessFile)
+	return readVmessFile(vmessFile)
+}
+
+func readVmessFile(filename string) ([]*vmess, error) {
+	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	var vmesses []*vmess
+	var avs []*annotatedVmess
 	decoder := json.NewDecoder(f)
-	return vmesses, decoder.Decode(&vmesses)
+	if err := decoder.Decode(&avs); err != nil {
+		return nil, err
+	}
+	return unannotated(avs), nil
 }
 
 const (
-	routingTag = "proxy"
+	routingTag     = "proxy"
+	httpInboundTag = "http"
 )
 
-func getV2rayConfig(inboundPort uint32) *core.Config {
-	return &core.Config{
-		Inbound: []*core.InboundHandlerConfig{
-			{
-				Tag: "http",
-				ReceiverSettings: serial.ToTypedMessage(&proxyman.ReceiverConfig{
-					PortRange: &net.PortRange{
-						From: inboundPort,
-						To:   inboundPort,
-					},
-					Listen: &net.IPOrDomain{
-						Address: &net.IPOrDomain_Ip{Ip: []byte{0, 0, 0, 0}},
-					},
-				}),
-				ProxySettings: serial.ToTypedMessage(&coreProxyHttp.ServerConfig{}),
-			},
+// localAddress 返回本机连接入站时使用的地址, 监听所有地址时使用回环地址
+func localAddress(listen string) string {
+	addr := net.ParseAddress(listen)
+	if addr.Family().IsDomain() || !addr.IP().IsUnspecified() {
+		return listen
+	}
+	if addr.Family().IsIPv6() {
+		return "::1"
+	}
+	return "127.0.0.1"
+}
+
+func newReceiverConfig(port uint32) *proxyman.ReceiverConfig {
+	return &proxyman.ReceiverConfig{
+		PortRange: &net.PortRange{
+			From: port,
+			To:   port,
 		},
+		Listen: net.NewIPOrDomain(net.ParseAddress(listenAddr)),
+	}
+}
+
+// proxyAccounts 返回入站的认证账号, 未设置 --username 时不认证
+func proxyAccounts() map[string]string {
+	if proxyUsername == "" {
+		return nil
+	}
+	return map[string]string{proxyUsername: proxyPassword}
+}
+
+func newHttpInbound(tag string, port uint32) *core.InboundHandlerConfig {
+	return &core.InboundHandlerConfig{
+		Tag:              tag,
+		ReceiverSettings: serial.ToTypedMessage(newReceiverConfig(port)),
+		ProxySettings: serial.ToTypedMessage(&coreProxyHttp.ServerConfig{
+			Accounts: proxyAccounts(),
+		}),
+	}
+}
+
+func newV2rayConfig(inbounds []*core.InboundHandlerConfig, routerConfig *router.Config) *core.Config {
+	return &core.Config{
+		Inbound: inbounds,
 		App: []*anypb.Any{
 			serial.ToTypedMessage(&log.Config{
 				Error: &log.LogSpecification{
 					Type:  log.LogType_Console,
-					Level: comLog.Severity_Warning,
+					Level: v2raySeverity(),
 				},
 				Access: &log.LogSpecification{
 					Type:  log.LogType_None,
@@ -147,22 +302,29 @@ func getV2rayConfig(inboundPort uint32) *core.Config {
 			serial.ToTypedMessage(&dispatcher.Config{}),
 			serial.ToTypedMessage(&proxyman.InboundConfig{}),
 			serial.ToTypedMessage(&proxyman.OutboundConfig{}),
-			serial.ToTypedMessage(&router.Config{
-				DomainStrategy: router.DomainStrategy_IpIfNonMatch,
-				Rule: []*router.RoutingRule{
-					{
-						TargetTag:     &router.RoutingRule_Tag{Tag: routingTag},
-						InboundTag:    []string{"http"},
-						DomainMatcher: "mph",
-					},
-				},
-			}),
+			serial.ToTypedMessage(routerConfig),
 		},
 	}
 }
 
-func startV2ray() (*core.Instance, error) {
-	ins, err := core.New(getV2rayConfig(inboundPort))
+func getV2rayConfig(inboundPort uint32) *core.Config {
+	return newV2rayConfig(
+		[]*core.InboundHandlerConfig{newHttpInbound(httpInboundTag, inboundPort)},
+		&router.Config{
+			DomainStrategy: router.DomainStrategy_IpIfNonMatch,
+			Rule: []*router.RoutingRule{
+				{
+					TargetTag:     &router.RoutingRule_Tag{Tag: routingTag},
+					InboundTag:    []string{httpInboundTag},
+					DomainMatcher: "mph",
+				},
+			},
+		},
+	)
+}
+
+func startV2ray(cfg *core.Config) (*core.Instance, error) {
+	ins, err := core.New(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("new v2ray core err: %s", err)
 	}
@@ -173,9 +335,9 @@ func startV2ray() (*core.Instance, error) {
 	return ins, nil
 }
 
-func addOutboundHandler(ins *core.Instance, vmess *vmess) error {
-	outboundConfig := &core.OutboundHandlerConfig{
-		Tag: routingTag,
+func newOutboundConfig(tag string, vmess *vmess) *core.OutboundHandlerConfig {
+	return &core.OutboundHandlerConfig{
+		Tag: tag,
 		SenderSettings: serial.ToTypedMessage(&proxyman.SenderConfig{
 			StreamSettings: &internet.StreamConfig{
 				Protocol:     internet.TransportProtocol_TCP,
@@ -184,72 +346,10 @@ func addOutboundHandler(ins *core.Instance, vmess *vmess) error {
 					{
 						Protocol:     internet.TransportProtocol_TCP,
 						ProtocolName: "tcp",
-						Settings: serial.ToTypedMessage(&tcp.Config{
-							HeaderSettings: serial.ToTypedMessage(&transHttp.Config{
-								Request: &transHttp.RequestConfig{
-									Version: &transHttp.Version{Value: "1.1"},
-									Method:  &transHttp.Method{Value: "GET"},
-									Uri:     []string{vmess.Path},
-									Header: []*transHttp.Header{
-										{
-											Name:  "Accept-Encoding",
-											Value: []string{"gzip,deflate"},
-										},
-										{
-											Name:  "Connection",
-											Value: []string{"keep-alive"},
-										},
-										{
-											Name:  "Host",
-											Value: []string{vmess.Host},
-										},
-										{
-											Name:  "Pragma",
-											Value: []string{"no-cache"},
-										},
-										{
-											Name: "User-Agent",
-											Value: []string{
-												"Mozilla/5.0 (Windows NT 10.0; WOW64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/53.0.2785.143 Safari/537.36",
-												"Mozilla/5.0 (iPhone; CPU iPhone OS 10_0_2 like Mac OS X) AppleWebKit/601.1 (KHTML, like Gecko) CriOS/53.0.2785.109 Mobile/14A456 Safari/601.1.46",
-											},
-										},
-									},
-								},
-								Response: &transHttp.ResponseConfig{
-									Header: []*transHttp.Header{
-										{
-											Name: "Content-Type",
-											Value: []string{
-												"application/octet-stream",
-												"video/mpeg",
-											},
-										},
-										{
-											Name:  "Transfer-Encoding",
-											Value: []string{"chunked"},
-										},
-										{
-											Name:  "Connection",
-											Value: []string{"keep-alive"},
-										},
-										{
-											Name:  "Pragma",
-											Value: []string{"no-cache"},
-										},
-										{
-											Name: "Cache-Control",
-											Value: []string{
-												"private",
-												"no-cache",
-											},
-										},
-									},
-								},
-							}),
-						}),
+						Settings:     serial.ToTypedMessage(newTCPConfig(vmess)),
 					},
 				},
+				SocketSettings: outboundSocketConfig(),
 			},
 		}),
 		ProxySettings: serial.ToTypedMessage(&coreProxyVmessOutbound.Config{Receiver: []*protocol.ServerEndpoint{
@@ -267,19 +367,92 @@ func addOutboundHandler(ins *core.Instance, vmess *vmess) error {
 			},
 		}}),
 	}
+}
+
+// newTCPConfig 默认使用 http 伪装, type 为 none 时不伪装
+func newTCPConfig(vmess *vmess) *tcp.Config {
+	if vmess.Type == "none" {
+		return &tcp.Config{}
+	}
+	return &tcp.Config{
+		HeaderSettings: serial.ToTypedMessage(&transHttp.Config{
+			Request: &transHttp.RequestConfig{
+				Version: &transHttp.Version{Value: "1.1"},
+				Method:  &transHttp.Method{Value: "GET"},
+				Uri:     []string{vmess.Path},
+				Header: []*transHttp.Header{
+					{
+						Name:  "Accept-Encoding",
+						Value: []string{"gzip,deflate"},
+					},
+					{
+						Name:  "Connection",
+						Value: []string{"keep-alive"},
+					},
+					{
+						Name:  "Host",
+						Value: []string{vmess.Host},
+					},
+					{
+						Name:  "Pragma",
+						Value: []string{"no-cache"},
+					},
+					{
+						Name: "User-Agent",
+						Value: []string{
+							"Mozilla/5.0 (Windows NT 10.0; WOW64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/53.0.2785.143 Safari/537.36",
+							"Mozilla/5.0 (iPhone; CPU iPhone OS 10_0_2 like Mac OS X) AppleWebKit/601.1 (KHTML, like Gecko) CriOS/53.0.2785.109 Mobile/14A456 Safari/601.1.46",
+						},
+					},
+				},
+			},
+			Response: &transHttp.ResponseConfig{
+				Header: []*transHttp.Header{
+					{
+						Name: "Content-Type",
+						Value: []string{
+							"application/octet-stream",
+							"video/mpeg",
+						},
+					},
+					{
+						Name:  "Transfer-Encoding",
+						Value: []string{"chunked"},
+					},
+					{
+						Name:  "Connection",
+						Value: []string{"keep-alive"},
+					},
+					{
+						Name:  "Pragma",
+						Value: []string{"no-cache"},
+					},
+					{
+						Name: "Cache-Control",
+						Value: []string{
+							"private",
+							"no-cache",
+						},
+					},
+				},
+			},
+		}),
+	}
+}
 
-	err := core.AddOutboundHandler(ins, outboundConfig)
+func addOutboundHandler(ins *core.Instance, tag string, vmess *vmess) error {
+	err := core.AddOutboundHandler(ins, newOutboundConfig(tag, vmess))
 	if err != nil {
 		return fmt.Errorf("add outbound handler err: %s", err)
 	}
 	return nil
 }
 
-func removeOutboundHandler(ins *core.Instance) error {
+func removeOutboundHandler(ins *core.Instance, tag string) error {
 	outboundManager := ins.GetFeature(outbound.ManagerType()).(outbound.Manager)
-	err := outboundManager.RemoveHandler(context.Background(), routingTag)
+	err := outboundManager.RemoveHandler(context.Background(), tag)
 	if err != nil {
-		return fmt.Errorf("remove handler %s err: %s", routingTag, err)
+		return fmt.Errorf("remove handler %s err: %s", tag, err)
 	}
 	return nil
 }
@@ -300,27 +473,58 @@ func tryPing(c *http.Client, host string) (time.Duration, error) {
 
 type pingStat struct {
 	v   *vmess
+	tag string
 	dur time.Duration
+	err error
+}
+
+// sortPingStats 按延迟排序, 失败的节点排在最后
+func sortPingStats(pingStats []pingStat) {
+	sort.SliceStable(pingStats, func(i, j int) bool {
+		if (pingStats[i].err == nil) != (pingStats[j].err == nil) {
+			return pingStats[i].err == nil
+		}
+		return pingStats[i].dur < pingStats[j].dur
+	})
+}
+
+func (s pingStat) String() string {
+	if s.err != nil {
+		return fmt.Sprintf("%-s failed", s.v.Ps)
+	}
+	return fmt.Sprintf("%-s %4dms", s.v.Ps, s.dur.Milliseconds())
 }
 
 func pingRun(cmd *cobra.Command, args []string) {
-	host := args[0]
+	if groupBy != "" && groupBy != groupByCountry {
+		cmd.PrintErrf("unknown group-by: %s, supported: %s\n", groupBy, groupByCountry)
+		return
+	}
+
+	host := probeURL
+	if len(args) > 0 {
+		host = args[0]
+	}
 	c := getHttpClient()
+	c.Timeout = pingTimeout
 	vmesses, err := getVmessFromFile()
 	if err != nil {
 		cmd.PrintErrf("get vmess err: %s", err)
 		return
 	}
+	vmesses = filterSupportedVmess(filterValidVmess(vmesses))
 
-	ins, err := startV2ray()
+	ins, err := startV2ray(getV2rayConfig(inboundPort))
 	if err != nil {
+		cmd.PrintErrln(err)
 		return
 	}
 	defer ins.Close()
 
 	var pingStats []pingStat
+	checkedAt := time.Now()
 	for _, v := range vmesses {
-		err := addOutboundHandler(ins, v)
+		err := addOutboundHandler(ins, routingTag, v)
 		if err != nil {
 			cmd.PrintErrln(err)
 			return
@@ -328,26 +532,58 @@ func pingRun(cmd *cobra.Command, args []string) {
 
 		dur, err := tryPing(c, host)
 		if err != nil {
-			cmd.PrintErrf("ping err: %s", err)
+			nodeLogger(routingTag, v).Warnw("ping failed", "url", host, "err", err)
+		} else {
+			nodeLogger(routingTag, v).Debugw("ping done", "url", host, "delay", dur)
 		}
 
 		pingStats = append(pingStats, pingStat{
 			v:   v,
 			dur: dur,
+			err: err,
 		})
 
-		err = removeOutboundHandler(ins)
+		err = removeOutboundHandler(ins, routingTag)
 		if err != nil {
 			cmd.PrintErrln(err)
 			return
 		}
 	}
 
-	sort.Slice(pingStats, func(i, j int) bool {
-		return pingStats[i].dur < pingStats[j].dur
+	sortPingStats(pingStats)
+	recordHistory(func(h *historyDB) error {
+		return h.RecordSamples(pingStats, host, checkedAt)
 	})
 
+	if groupBy == groupByCountry {
+		printPingStatsByCountry(cmd, pingStats)
+		return
+	}
 	for i, v := range pingStats {
-		cmd.Printf("%3d. %-s %4dms\n", i+1, v.v.Ps, v.dur.Milliseconds())
+		cmd.Printf("%3d. %s\n", i+1, v)
+	}
+}
+
+// printPingStatsByCountry 按国家分组输出, 国家代码来自 parse --resolve
+func printPingStatsByCountry(cmd *cobra.Command, pingStats []pingStat) {
+	var countries []string
+	groups := make(map[string][]pingStat)
+	for _, v := range pingStats {
+		country := strings.ToUpper(v.v.Country)
+		if country == "" {
+			country = "??"
+		}
+		if _, ok := groups[country]; !ok {
+			countries = append(countries, country)
+		}
+		groups[country] = append(groups[country], v)
+	}
+	sort.Strings(countries)
+
+	for _, country := range countries {
+		cmd.Printf("[%s]\n", country)
+		for i, v := range groups[country] {
+			cmd.Printf("%3d. %s\n", i+1, v)
+		}
 	}
 }
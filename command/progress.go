@@ -0,0 +1,176 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progress 输出多个下载任务的进度, 终端中在同一行刷新, 否则按 10% 输出日志
+type progress struct {
+	mu    sync.Mutex
+	w     io.Writer
+	tty   bool
+	tasks []*progressTask
+	last  time.Time
+}
+
+type progressTask struct {
+	p     *progress
+	name  string
+	total int64
+	done  int64
+	step  int64
+}
+
+func newProgress(w io.Writer) *progress {
+	return &progress{
+		w:   w,
+		tty: isTerminal(w),
+	}
+}
+
+func isTerminal(w io.Writer) bool {
+	// cmd.ErrOrStderr() 是隐藏密钥的 os.Stderr
+	if r, ok := w.(*redactWriter); ok {
+		w = r.w
+	}
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Task 添加一个任务, total 未知时为 -1, done 为续传的起始位置
+func (p *progress) Task(name string, total, done int64) *progressTask {
+	t := &progressTask{
+		p:     p,
+		name:  name,
+		total: total,
+		done:  done,
+		step:  -1,
+	}
+	if p == nil {
+		return t
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tasks = append(p.tasks, t)
+	p.render(t, true)
+	return t
+}
+
+// Logf 输出一行日志, 不会被进度行覆盖
+func (p *progress) Logf(format string, args ...interface{}) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tty {
+		fmt.Fprint(p.w, "\r\033[K")
+	}
+	fmt.Fprintf(p.w, format, args...)
+	if p.tty {
+		p.redraw()
+	}
+}
+
+func (t *progressTask) Write(b []byte) (int, error) {
+	if t.p == nil {
+		t.done += int64(len(b))
+		return len(b), nil
+	}
+
+	t.p.mu.Lock()
+	defer t.p.mu.Unlock()
+	t.done += int64(len(b))
+	t.p.render(t, false)
+	return len(b), nil
+}
+
+// Finish 标记任务结束, 并从终端的进度行中移除
+func (t *progressTask) Finish() {
+	p := t.p
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, task := range p.tasks {
+		if task == t {
+			p.tasks = append(p.tasks[:i], p.tasks[i+1:]...)
+			break
+		}
+	}
+	if !p.tty {
+		p.render(t, t.total <= 0)
+		return
+	}
+	fmt.Fprintf(p.w, "\r\033[K%s\n", t.String())
+	p.redraw()
+}
+
+func (t *progressTask) String() string {
+	if t.total <= 0 {
+		return fmt.Sprintf("%s %s", t.name, formatBytes(t.done))
+	}
+	return fmt.Sprintf("%s %3d%% (%s/%s)", t.name, t.done*100/t.total,
+		formatBytes(t.done), formatBytes(t.total))
+}
+
+func (p *progress) render(t *progressTask, force bool) {
+	if p.tty {
+		if force || time.Since(p.last) > 100*time.Millisecond {
+			p.redraw()
+		}
+		return
+	}
+
+	// 非终端每 10% 或每 10MB 输出一次
+	step := t.done / (10 << 20)
+	if t.total > 0 {
+		step = t.done * 10 / t.total
+	}
+	if force || step != t.step {
+		t.step = step
+		fmt.Fprintf(p.w, "%s\n", t.String())
+	}
+}
+
+func (p *progress) redraw() {
+	p.last = time.Now()
+	if len(p.tasks) == 0 {
+		return
+	}
+
+	lines := make([]string, 0, len(p.tasks))
+	for _, t := range p.tasks {
+		lines = append(lines, t.String())
+	}
+	fmt.Fprintf(p.w, "\r\033[K%s", strings.Join(lines, " | "))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,108 @@
+package command
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/jdxj/v2ray-bot/logger"
+	"github.com/spf13/cobra"
+)
+
+const redacted = "***"
+
+var (
+	urlPattern      = regexp.MustCompile(`(?i)\b(?:https?|smtps?|vmess|vless|ss|trojan)://[^\s"'<>]+`)
+	uuidPattern     = regexp.MustCompile(`(?i)\b([0-9a-f]{8})-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`)
+	botTokenPattern = regexp.MustCompile(`\b\d{6,}:[A-Za-z0-9_-]{30,}\b`)
+	// 订阅地址路径中的 token, 例如 /link/AbCdEf0123456789
+	pathTokenPattern = regexp.MustCompile(`^[A-Za-z0-9_:-]{16,}$`)
+)
+
+func init() {
+	rootCmd.SetErr(&redactWriter{w: os.Stderr})
+	logger.SetRedact(redact)
+}
+
+// secretValues 返回参数中的密钥, 出现在任何位置都需要隐藏
+func secretValues() []string {
+	secrets := []string{botToken, apiToken, proxyPassword}
+	if u, err := url.Parse(notifySMTP); err == nil && u.User != nil {
+		password, _ := u.User.Password()
+		secrets = append(secrets, password)
+	}
+	return secrets
+}
+
+// redact 隐藏日志和错误中的订阅 token, uuid 和密码:
+// url 只保留协议, 域名和参数名, uuid 只保留第一段
+func redact(s string) string {
+	s = urlPattern.ReplaceAllStringFunc(s, redactURL)
+	s = uuidPattern.ReplaceAllString(s, "${1}-"+redacted)
+	s = botTokenPattern.ReplaceAllString(s, redacted)
+	for _, secret := range secretValues() {
+		// 太短的值容易误伤正常内容
+		if len(secret) >= 4 {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+	}
+	return s
+}
+
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		scheme, _, _ := strings.Cut(raw, "://")
+		return scheme + "://" + redacted
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "vmess", "vless", "ss", "trojan":
+		// 分享链接中全部都是节点的连接参数
+		return u.Scheme + "://" + redacted
+	}
+
+	b := &strings.Builder{}
+	b.WriteString(u.Scheme + "://")
+	if u.User != nil {
+		b.WriteString(redacted + "@")
+	}
+	b.WriteString(u.Host)
+
+	segments := strings.Split(u.EscapedPath(), "/")
+	for i, seg := range segments {
+		if pathTokenPattern.MatchString(seg) {
+			segments[i] = redacted
+		}
+	}
+	b.WriteString(strings.Join(segments, "/"))
+
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		for i, p := range params {
+			key, _, _ := strings.Cut(p, "=")
+			params[i] = key + "=" + redacted
+		}
+		b.WriteString("?" + strings.Join(params, "&"))
+	}
+	return b.String()
+}
+
+// redactedOut 返回 cmd.Printf 使用的输出, 写入前隐藏密钥.
+// 用于 diff 等给人看的结果, parse 和 config show 等输出数据的命令不使用它
+func redactedOut(cmd *cobra.Command) io.Writer {
+	return &redactWriter{w: cmd.OutOrStderr()}
+}
+
+// redactWriter 在输出前隐藏密钥, cmd.PrintErr* 都经过它
+type redactWriter struct {
+	w io.Writer
+}
+
+func (r *redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
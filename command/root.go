@@ -9,11 +9,41 @@ func Execute() {
 }
 
 var rootCmd = &cobra.Command{
-	Use:                        "v2raybot",
-	Aliases:                    nil,
-	SuggestFor:                 nil,
-	Short:                      "",
-	Long:                       "",
+	Use:        "v2raybot",
+	Aliases:    nil,
+	SuggestFor: nil,
+	Short:      "",
+	Long: `settings may also be given in $XDG_CONFIG_HOME/v2ray-bot/config.yaml
+(or --config), keys are the same as flags and flags given on the command
+line take precedence:
+
+  subscriptions: [https://example.com/sub]
+  log:      {log-level: info, log-format: json}
+  filter:   {include: HK|JP, exclude: test, rename: ["^=>[x] "], keep-dead: false}
+  ping:     {probe-url: https://www.google.com/generate_204, timeout: 10s, history: true}
+  inbound:  {listen: 0.0.0.0, socks-udp-addr: 192.168.1.2, username: u, password_file: /run/secrets/proxy}
+  bot:      {token: xxx, api-url: https://api.telegram.org, allow-chat: [123456]}
+  serve:    {addr: 127.0.0.1:8080, api-token: secret}
+  daemon:   {sub-cron: "@every 1h", ping-cron: "@every 10m", metrics-addr: 127.0.0.1:9091}
+  notify:   {telegram: [123456], webhook: [https://example.com/hook], alert-expire: 72h}
+
+  profile: home        # default profile, --profile overrides it
+  profiles:
+    home: {inbound: {inbound-port: 7891}}
+    work: {ping: {timeout: 5s}}
+
+settings of the selected profile override the top level ones. a key with
+the _file suffix reads the value from a file, one value per line:
+
+  bot: {token_file: /run/secrets/bot-token}
+
+every flag can also be set by a V2RAYBOT_ environment variable, e.g.
+V2RAYBOT_API_TOKEN, or read from the file named by V2RAYBOT_API_TOKEN_FILE,
+lists are separated by commas or newlines, --rename only by newlines
+since its patterns may contain commas. the order is: flags, environment, config file.
+
+subscription tokens, uuids and passwords are hidden in logs and errors,
+"config show --redacted" prints the settings in use without them.`,
 	Example:                    "",
 	ValidArgs:                  nil,
 	ValidArgsFunction:          nil,
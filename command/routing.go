@@ -0,0 +1,323 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	core "github.com/v2fly/v2ray-core/v5"
+	"github.com/v2fly/v2ray-core/v5/app/proxyman"
+	"github.com/v2fly/v2ray-core/v5/app/router"
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+	coreNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/serial"
+	"github.com/v2fly/v2ray-core/v5/proxy/blackhole"
+	"github.com/v2fly/v2ray-core/v5/proxy/freedom"
+	"github.com/v2fly/v2ray-core/v5/transport/internet"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	directTag = "direct"
+	blockTag  = "block"
+
+	rulesDefault = "default"
+)
+
+// routingRule 是规则文件中的一条规则, 按顺序匹配, 都不匹配时走代理
+type routingRule struct {
+	// direct, proxy 或 block
+	Outbound string `yaml:"outbound" json:"outbound"`
+	// geosite:cn, ext:custom.dat:company, domain:, full:, regexp:, keyword: 或不带前缀的域名
+	Domain []string `yaml:"domain" json:"domain"`
+	// geoip:cn, ext:custom.dat:office, CIDR 或 IP
+	IP []string `yaml:"ip" json:"ip"`
+	// 53,443,1000-2000
+	Port string `yaml:"port" json:"port"`
+	// tcp, udp
+	Network string `yaml:"network" json:"network"`
+}
+
+type routingRules struct {
+	// AsIs, IPIfNonMatch 或 IPOnDemand
+	DomainStrategy string         `yaml:"domainStrategy" json:"domainStrategy"`
+	Rules          []*routingRule `yaml:"rules" json:"rules"`
+}
+
+// defaultRoutingRules 屏蔽广告, 国内和私有地址直连
+var defaultRoutingRules = &routingRules{
+	DomainStrategy: "IPIfNonMatch",
+	Rules: []*routingRule{
+		{Outbound: blockTag, Domain: []string{"geosite:category-ads-all"}},
+		{Outbound: directTag, Domain: []string{"geosite:private", "geosite:cn"}},
+		{Outbound: directTag, IP: []string{"geoip:private", "geoip:cn"}},
+	},
+}
+
+// loadRoutingRules 读取 yaml 或 json 格式的规则文件, name 为 default 时使用内置规则
+func loadRoutingRules(name string) (*routingRules, error) {
+	if name == rulesDefault {
+		return defaultRoutingRules, nil
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	rules := &routingRules{}
+	return rules, yaml.Unmarshal(data, rules)
+}
+
+// geoLoader 按需加载并缓存 geo 文件
+type geoLoader struct {
+	geoIPPath   string
+	geoSitePath string
+	ips         map[string]*routercommon.GeoIPList
+	sites       map[string]*routercommon.GeoSiteList
+}
+
+func newGeoLoader(geoIPPath, geoSitePath string) *geoLoader {
+	return &geoLoader{
+		geoIPPath:   geoIPPath,
+		geoSitePath: geoSitePath,
+		ips:         make(map[string]*routercommon.GeoIPList),
+		sites:       make(map[string]*routercommon.GeoSiteList),
+	}
+}
+
+// splitGeoRef 把 geosite:cn 或 ext:custom.dat:cn 拆成文件和分类
+func splitGeoRef(ref, defaultFile string) (string, string, error) {
+	if strings.HasPrefix(ref, "ext:") {
+		parts := strings.SplitN(strings.TrimPrefix(ref, "ext:"), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return "", "", fmt.Errorf("invalid ext rule: %s", ref)
+		}
+		return parts[0], parts[1], nil
+	}
+	_, code, _ := strings.Cut(ref, ":")
+	return defaultFile, code, nil
+}
+
+func (l *geoLoader) GeoSite(ref string) ([]*routercommon.Domain, error) {
+	file, code, err := splitGeoRef(ref, l.geoSitePath)
+	if err != nil {
+		return nil, err
+	}
+	code, attr, _ := strings.Cut(code, "@")
+
+	list, ok := l.sites[file]
+	if !ok {
+		list, err = loadGeoSiteList(file)
+		if err != nil {
+			return nil, err
+		}
+		l.sites[file] = list
+	}
+
+	for _, site := range list.GetEntry() {
+		if !strings.EqualFold(site.GetCountryCode(), code) {
+			continue
+		}
+		if attr == "" {
+			return site.GetDomain(), nil
+		}
+		var domains []*routercommon.Domain
+		for _, d := range site.GetDomain() {
+			for _, a := range d.GetAttribute() {
+				if strings.EqualFold(a.GetKey(), attr) {
+					domains = append(domains, d)
+					break
+				}
+			}
+		}
+		return domains, nil
+	}
+	return nil, fmt.Errorf("%s not found in %s", code, file)
+}
+
+func (l *geoLoader) GeoIP(ref string) (*routercommon.GeoIP, error) {
+	file, code, err := splitGeoRef(ref, l.geoIPPath)
+	if err != nil {
+		return nil, err
+	}
+
+	list, ok := l.ips[file]
+	if !ok {
+		list, err = loadGeoIPList(file)
+		if err != nil {
+			return nil, err
+		}
+		l.ips[file] = list
+	}
+
+	for _, geoIP := range list.GetEntry() {
+		if strings.EqualFold(geoIP.GetCountryCode(), code) {
+			return geoIP, nil
+		}
+	}
+	return nil, fmt.Errorf("%s not found in %s", code, file)
+}
+
+var domainStrategies = map[string]router.DomainStrategy{
+	"":             router.DomainStrategy_IpIfNonMatch,
+	"asis":         router.DomainStrategy_AsIs,
+	"ipifnonmatch": router.DomainStrategy_IpIfNonMatch,
+	"ipondemand":   router.DomainStrategy_IpOnDemand,
+}
+
+// compileRoutingRules 将规则编译为 router.Config 中的规则, 代理规则指向负载均衡器
+func compileRoutingRules(rules *routingRules, loader *geoLoader) (router.DomainStrategy, []*router.RoutingRule, error) {
+	strategy, ok := domainStrategies[strings.ToLower(rules.DomainStrategy)]
+	if !ok {
+		return 0, nil, fmt.Errorf("unknown domain strategy: %s", rules.DomainStrategy)
+	}
+
+	var result []*router.RoutingRule
+	for i, rule := range rules.Rules {
+		rr, err := compileRoutingRule(rule, loader)
+		if err != nil {
+			return 0, nil, fmt.Errorf("rule %d: %s", i+1, err)
+		}
+		result = append(result, rr...)
+	}
+	return strategy, result, nil
+}
+
+// compileRoutingRule 同时包含域名和 IP 的规则会拆成两条, 与 v2ray 的语义一致: 任意一个匹配即可
+func compileRoutingRule(rule *routingRule, loader *geoLoader) ([]*router.RoutingRule, error) {
+	newRule := func() (*router.RoutingRule, error) {
+		rr := &router.RoutingRule{DomainMatcher: "mph"}
+		switch rule.Outbound {
+		case directTag, blockTag:
+			rr.TargetTag = &router.RoutingRule_Tag{Tag: rule.Outbound}
+		case routingTag:
+			rr.TargetTag = &router.RoutingRule_BalancingTag{BalancingTag: balancerTag}
+		default:
+			return nil, fmt.Errorf("unknown outbound: %s", rule.Outbound)
+		}
+
+		if rule.Port != "" {
+			portList, err := parsePortList(rule.Port)
+			if err != nil {
+				return nil, err
+			}
+			rr.PortList = portList
+		}
+		for _, network := range strings.Split(rule.Network, ",") {
+			switch strings.TrimSpace(network) {
+			case "":
+			case "tcp":
+				rr.Networks = append(rr.Networks, coreNet.Network_TCP)
+			case "udp":
+				rr.Networks = append(rr.Networks, coreNet.Network_UDP)
+			default:
+				return nil, fmt.Errorf("unknown network: %s", network)
+			}
+		}
+		return rr, nil
+	}
+
+	var result []*router.RoutingRule
+	if len(rule.Domain) > 0 {
+		rr, err := newRule()
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range rule.Domain {
+			if strings.HasPrefix(d, "geosite:") || strings.HasPrefix(d, "ext:") {
+				domains, err := loader.GeoSite(d)
+				if err != nil {
+					return nil, err
+				}
+				rr.Domain = append(rr.Domain, domains...)
+				continue
+			}
+			domain, err := parseDomainRule(d)
+			if err != nil {
+				return nil, err
+			}
+			rr.Domain = append(rr.Domain, domain)
+		}
+		result = append(result, rr)
+	}
+
+	if len(rule.IP) > 0 {
+		rr, err := newRule()
+		if err != nil {
+			return nil, err
+		}
+		custom := &routercommon.GeoIP{}
+		for _, ip := range rule.IP {
+			if strings.HasPrefix(ip, "geoip:") || strings.HasPrefix(ip, "ext:") {
+				geoIP, err := loader.GeoIP(ip)
+				if err != nil {
+					return nil, err
+				}
+				rr.Geoip = append(rr.Geoip, geoIP)
+				continue
+			}
+			cidr, err := parseCIDR(ip)
+			if err != nil {
+				return nil, err
+			}
+			custom.Cidr = append(custom.Cidr, cidr)
+		}
+		if len(custom.Cidr) > 0 {
+			rr.Geoip = append(rr.Geoip, custom)
+		}
+		result = append(result, rr)
+	}
+
+	// 只有端口或网络条件的规则
+	if len(result) == 0 {
+		rr, err := newRule()
+		if err != nil {
+			return nil, err
+		}
+		if rr.PortList == nil && len(rr.Networks) == 0 {
+			return nil, fmt.Errorf("rule has no condition")
+		}
+		result = append(result, rr)
+	}
+	return result, nil
+}
+
+func parsePortList(ports string) (*coreNet.PortList, error) {
+	portList := &coreNet.PortList{}
+	for _, p := range strings.Split(ports, ",") {
+		from, to, isRange := strings.Cut(strings.TrimSpace(p), "-")
+		if !isRange {
+			to = from
+		}
+		f, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port: %s", p)
+		}
+		t, err := strconv.ParseUint(to, 10, 16)
+		if err != nil || t < f {
+			return nil, fmt.Errorf("invalid port: %s", p)
+		}
+		portList.Range = append(portList.Range, &coreNet.PortRange{From: uint32(f), To: uint32(t)})
+	}
+	return portList, nil
+}
+
+func newDirectOutbound() *core.OutboundHandlerConfig {
+	return &core.OutboundHandlerConfig{
+		Tag: directTag,
+		SenderSettings: serial.ToTypedMessage(&proxyman.SenderConfig{
+			StreamSettings: &internet.StreamConfig{
+				SocketSettings: outboundSocketConfig(),
+			},
+		}),
+		ProxySettings: serial.ToTypedMessage(&freedom.Config{}),
+	}
+}
+
+func newBlockOutbound() *core.OutboundHandlerConfig {
+	return &core.OutboundHandlerConfig{
+		Tag:           blockTag,
+		ProxySettings: serial.ToTypedMessage(&blackhole.Config{}),
+	}
+}
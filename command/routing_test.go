@@ -0,0 +1,105 @@
+package command
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/v2fly/v2ray-core/v5/app/router"
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+)
+
+func TestCompileRoutingRules(t *testing.T) {
+	dir := t.TempDir()
+	sites := &routercommon.GeoSiteList{
+		Entry: []*routercommon.GeoSite{
+			{
+				CountryCode: "CN",
+				Domain: []*routercommon.Domain{
+					{Type: routercommon.Domain_RootDomain, Value: "baidu.com"},
+					{
+						Type:      routercommon.Domain_RootDomain,
+						Value:     "google.cn",
+						Attribute: []*routercommon.Domain_Attribute{{Key: "ads"}},
+					},
+				},
+			},
+		},
+	}
+	ips := &routercommon.GeoIPList{
+		Entry: []*routercommon.GeoIP{
+			{
+				CountryCode: "CN",
+				Cidr:        []*routercommon.CIDR{{Ip: net.ParseIP("1.0.1.0").To4(), Prefix: 24}},
+			},
+		},
+	}
+	siteFile := filepath.Join(dir, "geosite.dat")
+	ipFile := filepath.Join(dir, "geoip.dat")
+	if err := writeProto(siteFile, sites); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if err := writeProto(ipFile, ips); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	rulesFile := filepath.Join(dir, "rules.yaml")
+	err := os.WriteFile(rulesFile, []byte(`
+domainStrategy: AsIs
+rules:
+  - outbound: block
+    domain: ["geosite:cn@ads"]
+  - outbound: direct
+    domain: [geosite:cn, "full:www.example.com"]
+    ip: [geoip:cn, 10.0.0.0/8]
+  - outbound: proxy
+    domain: ["ext:`+siteFile+`:cn"]
+    port: 443,8000-9000
+    network: tcp
+`), 0644)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	rules, err := loadRoutingRules(rulesFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	strategy, rr, err := compileRoutingRules(rules, newGeoLoader(ipFile, siteFile))
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if strategy != router.DomainStrategy_AsIs {
+		t.Fatalf("strategy: %s\n", strategy)
+	}
+	if len(rr) != 4 {
+		t.Fatalf("rules: %d\n", len(rr))
+	}
+
+	if tag := rr[0].GetTag(); tag != blockTag || len(rr[0].Domain) != 1 || rr[0].Domain[0].Value != "google.cn" {
+		t.Fatalf("block rule: %v\n", rr[0])
+	}
+	if tag := rr[1].GetTag(); tag != directTag || len(rr[1].Domain) != 3 {
+		t.Fatalf("direct domain rule: %v\n", rr[1])
+	}
+	if tag := rr[2].GetTag(); tag != directTag || len(rr[2].Geoip) != 2 || rr[2].Geoip[1].Cidr[0].Prefix != 8 {
+		t.Fatalf("direct ip rule: %v\n", rr[2])
+	}
+	if tag := rr[3].GetBalancingTag(); tag != balancerTag || len(rr[3].PortList.Range) != 2 || len(rr[3].Networks) != 1 {
+		t.Fatalf("proxy rule: %v\n", rr[3])
+	}
+
+	bad := []*routingRules{
+		{Rules: []*routingRule{{Outbound: "nowhere", Domain: []string{"example.com"}}}},
+		{Rules: []*routingRule{{Outbound: directTag, Domain: []string{"geosite:notfound"}}}},
+		{Rules: []*routingRule{{Outbound: directTag, Port: "70000"}}},
+		{Rules: []*routingRule{{Outbound: directTag}}},
+		{DomainStrategy: "fast", Rules: nil},
+	}
+	for i, rules := range bad {
+		if _, _, err := compileRoutingRules(rules, newGeoLoader(ipFile, siteFile)); err == nil {
+			t.Fatalf("bad rules %d compiled\n", i)
+		}
+	}
+}
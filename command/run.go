@@ -0,0 +1,515 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jdxj/v2ray-bot/logger"
+	"github.com/spf13/cobra"
+	core "github.com/v2fly/v2ray-core/v5"
+	"github.com/v2fly/v2ray-core/v5/app/observatory"
+	"github.com/v2fly/v2ray-core/v5/app/router"
+	"github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/serial"
+	"github.com/v2fly/v2ray-core/v5/features/routing"
+	coreProxySocks "github.com/v2fly/v2ray-core/v5/proxy/socks"
+	_ "github.com/v2fly/v2ray-core/v5/transport/internet/tagged/taggedimpl"
+)
+
+var run = &cobra.Command{
+	Use:        "run",
+	Aliases:    nil,
+	SuggestFor: nil,
+	Short:      "run a local socks+http proxy through the fastest node",
+	Long: `example:
+  run --vmess-file vmess.txt --inbound-port 7891 --socks-port 7892
+  V2RAYBOT_PASSWORD_FILE=/run/secrets/proxy run --listen 0.0.0.0 --socks-udp-addr 192.168.1.2 --username user
+  run --tproxy-port 7893 --rules default
+  run --rules default
+  run --rules rules.yaml
+
+rules.yaml:
+  domainStrategy: IPIfNonMatch
+  rules:
+    - outbound: block
+      domain: [geosite:category-ads-all]
+    - outbound: direct
+      domain: [geosite:cn, domain:example.com]
+      ip: [geoip:private, geoip:cn, 10.0.0.0/8]
+    - outbound: proxy
+      domain: [ext:custom.dat:company]
+      port: 443
+      network: tcp`,
+	Example:                    "",
+	ValidArgs:                  nil,
+	ValidArgsFunction:          nil,
+	Args:                       nil,
+	ArgAliases:                 nil,
+	BashCompletionFunction:     "",
+	Deprecated:                 "",
+	Annotations:                nil,
+	Version:                    "",
+	PersistentPreRun:           nil,
+	PersistentPreRunE:          nil,
+	PreRun:                     nil,
+	PreRunE:                    nil,
+	Run:                        runRun,
+	RunE:                       nil,
+	PostRun:                    nil,
+	PostRunE:                   nil,
+	PersistentPostRun:          nil,
+	PersistentPostRunE:         nil,
+	FParseErrWhitelist:         cobra.FParseErrWhitelist{},
+	CompletionOptions:          cobra.CompletionOptions{},
+	TraverseChildren:           false,
+	Hidden:                     false,
+	SilenceErrors:              false,
+	SilenceUsage:               false,
+	DisableFlagParsing:         false,
+	DisableAutoGenTag:          false,
+	DisableFlagsInUseLine:      false,
+	DisableSuggestions:         false,
+	SuggestionsMinimumDistance: 0,
+}
+
+var (
+	socksPort     uint32
+	nameSocksPort = "socks-port"
+
+	socksUDPAddr     string
+	nameSocksUDPAddr = "socks-udp-addr"
+
+	probeURL     string
+	nameProbeURL = "probe-url"
+
+	probeInterval     time.Duration
+	nameProbeInterval = "probe-interval"
+
+	checkInterval     time.Duration
+	nameCheckInterval = "check-interval"
+
+	balanceStrategy     string
+	nameBalanceStrategy = "balance"
+
+	rulesFile     string
+	nameRulesFile = "rules"
+)
+
+func init() {
+	rootCmd.AddCommand(run)
+
+	run.Flags().
+		Uint32Var(&inboundPort, nameInboundPort, 7891, "port for v2ray http inbound")
+
+	run.Flags().
+		Uint32Var(&socksPort, nameSocksPort, 7892, "port for v2ray socks5 inbound, udp is supported")
+
+	run.Flags().
+		StringVar(&socksUDPAddr, nameSocksUDPAddr, "",
+			"address sent to socks5 clients for udp, defaults to --listen, set to the lan address when listening on 0.0.0.0")
+
+	run.Flags().
+		StringVar(&listenAddr, nameListen, "127.0.0.1", "listen address for http and socks inbounds, 0.0.0.0 for lan access")
+
+	run.Flags().
+		StringVar(&proxyUsername, nameProxyUsername, "", "username of http and socks inbounds, empty for no auth")
+
+	run.Flags().
+		StringVar(&proxyPassword, nameProxyPassword, "",
+			"password of http and socks inbounds, visible in ps, prefer V2RAYBOT_PASSWORD or V2RAYBOT_PASSWORD_FILE")
+
+	run.Flags().
+		Uint32Var(&tproxyPort, nameTproxyPort, 0, "port of the transparent inbound for gateway use, 0 to disable (see tproxy cmd)")
+
+	run.Flags().
+		StringVar(&tproxyMode, nameTproxyMode, tproxyModeTProxy, "tproxy (tcp and udp) or redirect (tcp only)")
+
+	run.Flags().
+		Uint32Var(&outboundMark, nameOutboundMark, 255, "SO_MARK set on outbound connections when --tproxy-port is set")
+
+	run.Flags().
+		StringVar(&vmessFile, nameVmessFile, "vmess.txt", "parsed vmess config (parse cmd)")
+
+	run.Flags().
+		StringVar(&probeURL, nameProbeURL, "https://www.google.com/generate_204", "url used to measure nodes")
+
+	run.Flags().
+		DurationVar(&probeInterval, nameProbeInterval, 10*time.Minute, "interval of re-probing all nodes")
+
+	run.Flags().
+		DurationVar(&checkInterval, nameCheckInterval, 30*time.Second, "interval of checking the current node")
+
+	run.Flags().
+		DurationVar(&pingTimeout, namePingTimeout, 10*time.Second, "timeout of each probe")
+
+	run.Flags().
+		StringVar(&balanceStrategy, nameBalanceStrategy, balanceFastest,
+			"how traffic is spread over nodes: fastest, random, leastping (observatory) "+
+				"or roundrobin (rotates healthy nodes every --check-interval)")
+
+	run.Flags().
+		StringVar(&rulesFile, nameRulesFile, "",
+			"routing rules file (yaml/json), \"default\" for built-in rules: block ads, direct cn and private")
+
+	run.Flags().
+		StringVar(&geoIP, nameGeoIP, geoIpFile, "path of geoip.dat used by routing rules")
+
+	run.Flags().
+		StringVar(&geoSite, nameGeoSite, geoSiteFile, "path of geosite.dat used by routing rules")
+}
+
+const (
+	socksInboundTag = "socks"
+	balancerTag     = "auto"
+	nodeTagPrefix   = "node-"
+	probeTagPrefix  = "probe-"
+)
+
+const (
+	balanceFastest    = "fastest"
+	balanceRandom     = "random"
+	balanceLeastPing  = "leastping"
+	balanceRoundRobin = "roundrobin"
+)
+
+// newSocksInbound 生成支持 UDP ASSOCIATE 的 socks5 入站, 与 http 入站使用相同的账号
+func newSocksInbound(tag string, port uint32) *core.InboundHandlerConfig {
+	config := &coreProxySocks.ServerConfig{
+		AuthType:   coreProxySocks.AuthType_NO_AUTH,
+		UdpEnabled: true,
+	}
+	if accounts := proxyAccounts(); accounts != nil {
+		config.AuthType = coreProxySocks.AuthType_PASSWORD
+		config.Accounts = accounts
+	}
+	if addr := socksUDPAddress(); addr != nil {
+		config.Address = net.NewIPOrDomain(addr)
+	}
+	return &core.InboundHandlerConfig{
+		Tag:              tag,
+		ReceiverSettings: serial.ToTypedMessage(newReceiverConfig(port)),
+		ProxySettings:    serial.ToTypedMessage(config),
+	}
+}
+
+// socksUDPAddress 返回 UDP ASSOCIATE 回复给客户端的地址, 监听所有地址时
+// 只能回复 0.0.0.0, 局域网客户端需要 --socks-udp-addr 指定本机的局域网地址
+func socksUDPAddress() net.Address {
+	if socksUDPAddr != "" {
+		return net.ParseAddress(socksUDPAddr)
+	}
+	addr := net.ParseAddress(listenAddr)
+	if addr.Family().IsIP() && addr.IP().IsUnspecified() {
+		return nil
+	}
+	return addr
+}
+
+func nodeTag(i int) string {
+	return fmt.Sprintf("%s%d", nodeTagPrefix, i)
+}
+
+// probeTag 是节点专用于测速的出站, 不参与负载均衡
+func probeTag(i int) string {
+	return fmt.Sprintf("%s%d", probeTagPrefix, i)
+}
+
+func probeTags(vmesses []*vmess) []string {
+	tags := make([]string, 0, len(vmesses))
+	for i := range vmesses {
+		tags = append(tags, probeTag(i))
+	}
+	return tags
+}
+
+func newBalancingRule(strategy string) (*router.BalancingRule, error) {
+	rule := &router.BalancingRule{
+		Tag:              balancerTag,
+		OutboundSelector: []string{nodeTagPrefix},
+	}
+	switch strategy {
+	case balanceFastest, balanceRandom, balanceRoundRobin:
+		// fastest 和 roundrobin 由 nodeSelector 覆盖负载均衡器的选择
+		rule.Strategy = "random"
+	case balanceLeastPing:
+		rule.Strategy = "leastping"
+		rule.StrategySettings = serial.ToTypedMessage(&router.StrategyLeastPingConfig{})
+		// 观测结果出来之前使用第一个节点
+		rule.FallbackTag = nodeTag(0)
+	default:
+		return nil, fmt.Errorf("unknown balance strategy: %s", strategy)
+	}
+	return rule, nil
+}
+
+// getProxyConfig 生成长期运行的代理配置, 所有节点都作为出站,
+// 先按 --rules 匹配, 其余入站流量交给 balancerTag 负载均衡器按 --balance 分配到各个节点
+func getProxyConfig(vmesses []*vmess) (*core.Config, error) {
+	balancingRule, err := newBalancingRule(balanceStrategy)
+	if err != nil {
+		return nil, err
+	}
+
+	domainStrategy := router.DomainStrategy_IpIfNonMatch
+	var rules []*router.RoutingRule
+	if rulesFile != "" {
+		rr, err := loadRoutingRules(rulesFile)
+		if err != nil {
+			return nil, fmt.Errorf("load rules err: %s", err)
+		}
+		domainStrategy, rules, err = compileRoutingRules(rr, newGeoLoader(geoIP, geoSite))
+		if err != nil {
+			return nil, fmt.Errorf("compile rules err: %s", err)
+		}
+	}
+
+	inbounds := []*core.InboundHandlerConfig{
+		newHttpInbound(httpInboundTag, inboundPort),
+		newSocksInbound(socksInboundTag, socksPort),
+	}
+	inboundTags := []string{httpInboundTag, socksInboundTag}
+	if tproxyPort != 0 {
+		inbound, err := newTransparentInbound(transparentInboundTag, tproxyPort, tproxyMode)
+		if err != nil {
+			return nil, err
+		}
+		inbounds = append(inbounds, inbound)
+		inboundTags = append(inboundTags, transparentInboundTag)
+	}
+
+	for _, rule := range rules {
+		rule.InboundTag = inboundTags
+	}
+	rules = append(rules, &router.RoutingRule{
+		TargetTag:     &router.RoutingRule_BalancingTag{BalancingTag: balancerTag},
+		InboundTag:    inboundTags,
+		DomainMatcher: "mph",
+	})
+
+	cfg := newV2rayConfig(
+		inbounds,
+		&router.Config{
+			DomainStrategy: domainStrategy,
+			Rule:           rules,
+			BalancingRule:  []*router.BalancingRule{balancingRule},
+		},
+	)
+	if balanceStrategy == balanceLeastPing {
+		cfg.App = append(cfg.App, serial.ToTypedMessage(&observatory.Config{
+			SubjectSelector: []string{nodeTagPrefix},
+			ProbeUrl:        probeURL,
+			ProbeInterval:   int64(checkInterval),
+		}))
+	}
+
+	for i, v := range vmesses {
+		cfg.Outbound = append(cfg.Outbound,
+			newOutboundConfig(nodeTag(i), v),
+			newOutboundConfig(probeTag(i), v),
+		)
+	}
+	// 放在节点之后, 保证默认出站是 node-0
+	if rulesFile != "" {
+		cfg.Outbound = append(cfg.Outbound, newDirectOutbound(), newBlockOutbound())
+	}
+	return cfg, nil
+}
+
+// nodeSelector 定期测速:
+// fastest 模式让负载均衡器始终使用最快的节点,
+// random 和 roundrobin 模式从负载均衡器中移除不可用的节点,
+// roundrobin 模式还会在每次检查时轮换到下一个可用节点.
+// leastping 模式由 observatory 负责测速.
+type nodeSelector struct {
+	ins      *core.Instance
+	strategy string
+	vmesses  []*vmess
+	// active[i] 表示 node-i 是否还在出站中
+	active  []bool
+	current int
+	// 最近一次测速结果, 顺序与 vmesses 一致
+	stats []pingStat
+}
+
+func newNodeSelector(ins *core.Instance, strategy string, vmesses []*vmess) *nodeSelector {
+	s := &nodeSelector{
+		ins:      ins,
+		strategy: strategy,
+		vmesses:  vmesses,
+		active:   make([]bool, len(vmesses)),
+		current:  -1,
+	}
+	for i := range s.active {
+		s.active[i] = true
+	}
+	return s
+}
+
+func (s *nodeSelector) Probe() error {
+	s.stats = probeOutbounds(s.ins, s.vmesses, probeTags(s.vmesses), probeURL)
+
+	best := -1
+	for i, stat := range s.stats {
+		if stat.err == nil && (best < 0 || stat.dur < s.stats[best].dur) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return fmt.Errorf("all nodes failed, err: %s", s.stats[0].err)
+	}
+
+	switch s.strategy {
+	case balanceFastest:
+		return s.switchTo(best)
+	case balanceRandom:
+		return s.updateActive()
+	case balanceRoundRobin:
+		if err := s.updateActive(); err != nil {
+			return err
+		}
+		if s.current < 0 || !s.active[s.current] {
+			return s.switchTo(best)
+		}
+	}
+	return nil
+}
+
+// Check 在 fastest 模式下检查当前节点, 不可用时重新测速; 在 roundrobin 模式下轮换节点
+func (s *nodeSelector) Check() error {
+	switch s.strategy {
+	case balanceFastest:
+		if s.current < 0 {
+			return s.Probe()
+		}
+		_, err := tryPing(newTaggedClient(s.ins, probeTag(s.current), pingTimeout), probeURL)
+		if err != nil {
+			nodeLogger(nodeTag(s.current), s.vmesses[s.current]).Warnw("check failed, re-probing", "err", err)
+			return s.Probe()
+		}
+	case balanceRoundRobin:
+		for i := 1; i <= len(s.vmesses); i++ {
+			next := (s.current + i) % len(s.vmesses)
+			if s.active[next] {
+				return s.switchTo(next)
+			}
+		}
+	}
+	return nil
+}
+
+// updateActive 根据测速结果增删负载均衡器中的节点, 全部失败时保持不变
+func (s *nodeSelector) updateActive() error {
+	for i, stat := range s.stats {
+		healthy := stat.err == nil
+		if healthy == s.active[i] {
+			continue
+		}
+
+		var err error
+		if healthy {
+			err = addOutboundHandler(s.ins, nodeTag(i), s.vmesses[i])
+			nodeLogger(nodeTag(i), s.vmesses[i]).Infow("node is back", "delay", stat.dur)
+		} else {
+			err = removeOutboundHandler(s.ins, nodeTag(i))
+			nodeLogger(nodeTag(i), s.vmesses[i]).Warnw("node is down", "err", stat.err)
+		}
+		if err != nil {
+			return err
+		}
+		s.active[i] = healthy
+	}
+	return nil
+}
+
+func (s *nodeSelector) switchTo(i int) error {
+	if i == s.current {
+		return nil
+	}
+
+	overrider := s.ins.GetFeature(routing.RouterType()).(routing.BalancerOverrider)
+	if err := overrider.SetOverrideTarget(balancerTag, nodeTag(i)); err != nil {
+		return fmt.Errorf("switch to %s err: %s", s.vmesses[i].Ps, err)
+	}
+	s.current = i
+	l := nodeLogger(nodeTag(i), s.vmesses[i])
+	if s.stats != nil {
+		l.Infow("switch node", "delay", s.stats[i].dur)
+	} else {
+		l.Infow("switch node")
+	}
+	return nil
+}
+
+func runRun(cmd *cobra.Command, args []string) {
+	vmesses, err := getVmessFromFile()
+	if err != nil {
+		cmd.PrintErrf("get vmess err: %s\n", err)
+		return
+	}
+	vmesses = filterSupportedVmess(filterValidVmess(vmesses))
+	if len(vmesses) == 0 {
+		cmd.PrintErrln("no valid node")
+		return
+	}
+
+	if cmd.Flags().Changed(nameProxyPassword) {
+		logger.Warnw("--password is visible to other users in the process list, use V2RAYBOT_PASSWORD_FILE instead")
+	}
+	if socksUDPAddress() == nil {
+		logger.Warnw("socks5 udp only works for local clients, set --socks-udp-addr for lan clients", "listen", listenAddr)
+	}
+
+	cfg, err := getProxyConfig(vmesses)
+	if err != nil {
+		cmd.PrintErrf("get v2ray config err: %s\n", err)
+		return
+	}
+	ins, err := startV2ray(cfg)
+	if err != nil {
+		cmd.PrintErrln(err)
+		return
+	}
+	defer ins.Close()
+	logger.Infow("proxy started",
+		"http", fmt.Sprintf("%s:%d", listenAddr, inboundPort),
+		"socks", fmt.Sprintf("%s:%d", listenAddr, socksPort),
+		"balance", balanceStrategy)
+	if tproxyPort != 0 {
+		logger.Infow("transparent proxy started", "mode", tproxyMode, "port", tproxyPort)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if balanceStrategy == balanceLeastPing {
+		<-ctx.Done()
+		return
+	}
+
+	selector := newNodeSelector(ins, balanceStrategy, vmesses)
+	if err := selector.Probe(); err != nil {
+		logger.Errorw("probe failed", "err", err)
+	}
+
+	probeTicker := time.NewTicker(probeInterval)
+	defer probeTicker.Stop()
+	checkTicker := time.NewTicker(checkInterval)
+	defer checkTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-probeTicker.C:
+			err = selector.Probe()
+		case <-checkTicker.C:
+			err = selector.Check()
+		}
+		if err != nil {
+			logger.Errorw("probe failed", "err", err)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package command
+
+import (
+	"testing"
+)
+
+func TestSocksUDPAddress(t *testing.T) {
+	defer func() {
+		listenAddr = "127.0.0.1"
+		socksUDPAddr = ""
+	}()
+
+	cases := []struct {
+		listen, udp, want string
+	}{
+		{listen: "127.0.0.1", want: "127.0.0.1"},
+		{listen: "192.168.1.2", want: "192.168.1.2"},
+		{listen: "0.0.0.0"},
+		{listen: "::"},
+		{listen: "0.0.0.0", udp: "192.168.1.2", want: "192.168.1.2"},
+		{listen: "0.0.0.0", udp: "proxy.lan", want: "proxy.lan"},
+	}
+	for _, c := range cases {
+		listenAddr, socksUDPAddr = c.listen, c.udp
+		addr := socksUDPAddress()
+		if c.want == "" {
+			if addr != nil {
+				t.Fatalf("listen: %s, addr: %s\n", c.listen, addr)
+			}
+			continue
+		}
+		if addr == nil || addr.String() != c.want {
+			t.Fatalf("listen: %s, udp: %s, addr: %v\n", c.listen, c.udp, addr)
+		}
+	}
+}
@@ -0,0 +1,529 @@
+package command
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jdxj/v2ray-bot/logger"
+	"github.com/spf13/cobra"
+)
+
+var serve = &cobra.Command{
+	Use:        "serve",
+	Aliases:    nil,
+	SuggestFor: nil,
+	Short:      "serve a json api for subscriptions, nodes, rankings and exports",
+	Long: `example:
+  serve --addr 127.0.0.1:8080 --api-token secret
+
+every request needs "Authorization: Bearer <api-token>":
+  GET    /api/subscriptions
+  POST   /api/subscriptions          {"url": "..."}
+  DELETE /api/subscriptions?url=...
+  GET    /api/nodes
+  POST   /api/ping                   start a ping job
+  GET    /api/ping/<id>              status of a ping job
+  GET    /api/rankings
+  GET    /api/export?format=json|share|clash|singbox
+  GET    /metrics                    prometheus metrics of nodes and subscriptions
+
+subscription for clients, token may also be given as ?token=:
+  GET    /sub?target=share|clash|singbox&include=HK|JP&exclude=test&rename=^=>[x] &dead=keep
+  merges all subscriptions, drops duplicated and dead nodes, orders by the latest
+  ranking, the format is picked by target or the User-Agent (clash, sing-box),
+  --include, --exclude, --rename and --keep-dead are used when not given in the query
+
+the ?token= of /sub ends up in client and proxy logs, set --sub-token so that
+it is a separate token which can only pull /sub, not the api token.
+
+nodes and rankings are shared with the daemon cmd.`,
+	Example:                    "",
+	ValidArgs:                  nil,
+	ValidArgsFunction:          nil,
+	Args:                       cobra.NoArgs,
+	ArgAliases:                 nil,
+	BashCompletionFunction:     "",
+	Deprecated:                 "",
+	Annotations:                nil,
+	Version:                    "",
+	PersistentPreRun:           nil,
+	PersistentPreRunE:          nil,
+	PreRun:                     nil,
+	PreRunE:                    nil,
+	Run:                        serveRun,
+	RunE:                       nil,
+	PostRun:                    nil,
+	PostRunE:                   nil,
+	PersistentPostRun:          nil,
+	PersistentPostRunE:         nil,
+	FParseErrWhitelist:         cobra.FParseErrWhitelist{},
+	CompletionOptions:          cobra.CompletionOptions{},
+	TraverseChildren:           false,
+	Hidden:                     false,
+	SilenceErrors:              false,
+	SilenceUsage:               false,
+	DisableFlagParsing:         false,
+	DisableAutoGenTag:          false,
+	DisableFlagsInUseLine:      false,
+	DisableSuggestions:         false,
+	SuggestionsMinimumDistance: 0,
+}
+
+var (
+	serveAddr     string
+	nameServeAddr = "addr"
+
+	apiToken     string
+	nameAPIToken = "api-token"
+
+	subToken     string
+	nameSubToken = "sub-token"
+)
+
+func init() {
+	rootCmd.AddCommand(serve)
+
+	serve.Flags().
+		StringVar(&serveAddr, nameServeAddr, "127.0.0.1:8080", "listen address of the api server")
+
+	serve.Flags().
+		StringVar(&apiToken, nameAPIToken, "", "bearer token required by every request")
+
+	serve.Flags().
+		StringVar(&subToken, nameSubToken, "", "token accepted by /sub?token=, it can only pull /sub, defaults to --api-token")
+
+	serve.Flags().
+		StringVar(&probeURL, nameProbeURL, "https://www.google.com/generate_204", "url used by ping jobs")
+
+	serve.Flags().
+		DurationVar(&pingTimeout, namePingTimeout, 10*time.Second, "timeout of each ping")
+
+	serve.Flags().
+		BoolVar(&saveHistory, nameSaveHistory, true, "save results to the history database (history cmd)")
+
+	serve.Flags().
+		StringVar(&subInclude, nameSubInclude, "", "default include of /sub")
+
+	serve.Flags().
+		StringVar(&subExclude, nameSubExclude, "", "default exclude of /sub")
+
+	serve.Flags().
+		StringArrayVar(&subRenames, nameSubRename, nil, "default rename of /sub, pattern=>replacement")
+
+	serve.Flags().
+		BoolVar(&subKeepDead, nameSubKeepDead, false, "keep dead nodes in /sub by default")
+}
+
+const (
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+
+	// 最多保留的 ping 任务数
+	maxPingJobs = 50
+)
+
+type pingJob struct {
+	ID         string        `json:"id"`
+	Status     string        `json:"status"`
+	CreatedAt  time.Time     `json:"created_at"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Ranking    *rankingState `json:"ranking,omitempty"`
+}
+
+type apiSubscription struct {
+	URL string `json:"url"`
+	// Managed 表示可以通过 api 或 bot 删除, 否则来自 daemon 的 --sub
+	Managed bool `json:"managed"`
+	// 最近一次刷新的结果, 还没刷新过时为空
+	State *subscriptionState `json:"state,omitempty"`
+}
+
+type apiNode struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Node *vmess `json:"node"`
+}
+
+type apiServer struct {
+	token string
+	// 只能用于 /sub?token=, 为空时使用 token
+	subToken string
+
+	state   *daemonState
+	runner  *daemonRunner
+	metrics *daemonMetrics
+
+	mu      sync.Mutex
+	jobs    map[string]*pingJob
+	jobIDs  []string
+	running *pingJob
+}
+
+func newAPIServer(token string, state *daemonState) *apiServer {
+	metrics := newDaemonMetrics(state)
+	return &apiServer{
+		token:   token,
+		state:   state,
+		runner:  &daemonRunner{state: state, metrics: metrics},
+		metrics: metrics,
+		jobs:    make(map[string]*pingJob),
+	}
+}
+
+func (s *apiServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/subscriptions", s.handleSubscriptions)
+	mux.HandleFunc("/api/nodes", s.handleNodes)
+	mux.HandleFunc("/api/ping", s.handlePing)
+	mux.HandleFunc("/api/ping/", s.handlePingJob)
+	mux.HandleFunc("/api/rankings", s.handleRankings)
+	mux.HandleFunc("/api/export", s.handleExport)
+	mux.HandleFunc("/sub", s.handleSub)
+	mux.Handle("/metrics", s.metrics.Handler())
+	return s.auth(mux)
+}
+
+func (s *apiServer) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorized 检查 Bearer token, 客户端拉取订阅时无法设置请求头, /sub 允许通过 ?token= 认证,
+// 它会出现在客户端和代理的日志中, 所以设置了 subToken 时只接受 subToken
+func (s *apiServer) authorized(r *http.Request) bool {
+	if token := bearerToken(r); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+	}
+	if r.URL.Path != "/sub" {
+		return false
+	}
+	want := s.token
+	if s.subToken != "" {
+		want = s.subToken
+	}
+	return subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(want)) == 1
+}
+
+// bearerToken 返回 "Authorization: Bearer <token>" 中的 token, scheme 不区分大小写
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": redact(err.Error())})
+}
+
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+func (s *apiServer) handleSubscriptions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+
+	store, err := loadBotStore()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		urls, err := s.subscriptionURLs()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		managed := make(map[string]bool)
+		for _, u := range store.Subscriptions {
+			managed[u] = true
+		}
+
+		subs := make([]*apiSubscription, 0, len(urls))
+		err = s.state.view(func() {
+			for _, u := range urls {
+				subs = append(subs, &apiSubscription{URL: u, Managed: managed[u], State: s.state.Subscriptions[u]})
+			}
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, subs)
+	case http.MethodPost:
+		var req struct {
+			URL string `json:"url"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.URL == "" {
+			writeError(w, http.StatusBadRequest, errors.New(`body must be {"url": "..."}`))
+			return
+		}
+		vmesses, _, err := parseFromURL(req.URL)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("parse subscription err: %s", err))
+			return
+		}
+		added, err := store.Add(req.URL)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !added {
+			writeError(w, http.StatusConflict, errors.New("subscription already exists"))
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"url": req.URL, "nodes": len(vmesses)})
+	case http.MethodDelete:
+		removed, err := store.Remove(r.URL.Query().Get("url"))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !removed {
+			writeError(w, http.StatusNotFound, errors.New("subscription not found"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// subscriptionURLs 返回 bot 中的订阅以及 daemon 刷新过的其他订阅
+func (s *apiServer) subscriptionURLs() ([]string, error) {
+	store, err := loadBotStore()
+	if err != nil {
+		return nil, err
+	}
+
+	urls := append([]string(nil), store.Subscriptions...)
+	seen := make(map[string]bool)
+	for _, u := range urls {
+		seen[u] = true
+	}
+	var others []string
+	err = s.state.view(func() {
+		for u := range s.state.Subscriptions {
+			if !seen[u] {
+				others = append(others, u)
+			}
+		}
+	})
+	sort.Strings(others)
+	urls = append(urls, others...)
+	return urls, err
+}
+
+func (s *apiServer) handleNodes(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	vmesses, err := s.state.nodes()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	names, _ := indexVmess(vmesses)
+	nodes := make([]*apiNode, 0, len(vmesses))
+	for i, v := range vmesses {
+		nodes = append(nodes, &apiNode{ID: i, Name: names[i], Node: v})
+	}
+	writeJSON(w, http.StatusOK, nodes)
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// handlePing 启动一个 ping 任务, 同一时间只运行一个
+func (s *apiServer) handlePing(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running != nil {
+		writeJSON(w, http.StatusConflict, s.running)
+		return
+	}
+
+	job := &pingJob{
+		ID:        newJobID(),
+		Status:    jobRunning,
+		CreatedAt: time.Now(),
+	}
+	s.addJob(job)
+	s.running = job
+	w.Header().Set("Location", "/api/ping/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+
+	go func() {
+		ranking, err := s.runner.rankNodes()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		now := time.Now()
+		job.FinishedAt = &now
+		job.Ranking = ranking
+		job.Status = jobDone
+		if err != nil {
+			job.Status = jobFailed
+			job.Error = err.Error()
+		}
+		s.running = nil
+	}()
+}
+
+// addJob 保存任务, 超过 maxPingJobs 时删除最早的已完成任务, 调用者需要持有锁
+func (s *apiServer) addJob(job *pingJob) {
+	s.jobs[job.ID] = job
+	s.jobIDs = append(s.jobIDs, job.ID)
+	for len(s.jobIDs) > maxPingJobs {
+		oldest := s.jobIDs[0]
+		if s.jobs[oldest].Status == jobRunning {
+			break
+		}
+		delete(s.jobs, oldest)
+		s.jobIDs = s.jobIDs[1:]
+	}
+}
+
+func (s *apiServer) handlePingJob(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[strings.TrimPrefix(r.URL.Path, "/api/ping/")]
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("job not found"))
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (s *apiServer) handleRankings(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	var ranking *rankingState
+	if err := s.state.view(func() { ranking = s.state.Ranking }); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if ranking == nil {
+		writeError(w, http.StatusNotFound, errors.New("no ranking yet, POST /api/ping first"))
+		return
+	}
+	writeJSON(w, http.StatusOK, ranking)
+}
+
+func (s *apiServer) handleExport(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = formatJSON
+	}
+	e, err := findExporter(format)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	vmesses, err := s.state.nodes()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	data, warnings, err := e.export(vmesses)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	if len(warnings) > 0 {
+		w.Header().Set("X-Export-Warnings", strings.Join(warnings, "; "))
+	}
+	w.Header().Set("Content-Type", e.contentType)
+	_, _ = w.Write(data)
+}
+
+func serveRun(cmd *cobra.Command, args []string) {
+	if apiToken == "" {
+		cmd.PrintErrln("--api-token is required")
+		return
+	}
+
+	state, err := loadDaemonState()
+	if err != nil {
+		cmd.PrintErrf("load daemon state err: %s\n", err)
+		return
+	}
+
+	api := newAPIServer(apiToken, state)
+	api.subToken = subToken
+	srv := &http.Server{
+		Addr:              serveAddr,
+		Handler:           api.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	logger.Infow("api server started", "addr", serveAddr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Errorw("serve failed", "err", err)
+	}
+}
@@ -0,0 +1,159 @@
+package command
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func apiRequest(t *testing.T, method, url, token, body string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer rsp.Body.Close()
+	data, _ := io.ReadAll(rsp.Body)
+	return rsp, data
+}
+
+func TestAPIServer(t *testing.T) {
+	setXDGDir(t, "XDG_CACHE_HOME", t.TempDir())
+	setXDGDir(t, "XDG_DATA_HOME", t.TempDir())
+
+	share := newShare(
+		&vmess{Ps: "a", Id: "2015cdb0-4f09-4796-7ec6-91b2e5dc2923", Add: "a.example.com", Port: 443, Net: "ws", Path: "/ws"},
+		&vmess{Ps: "a", Id: "2015cdb0-4f09-4796-7ec6-91b2e5dc2923", Add: "b.example.com", Port: 443, Type: "http"},
+	)
+	sub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(share)
+	}))
+	defer sub.Close()
+
+	state, err := loadDaemonState()
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	srv := httptest.NewServer(newAPIServer("secret", state).Handler())
+	defer srv.Close()
+
+	if rsp, _ := apiRequest(t, http.MethodGet, srv.URL+"/api/nodes", "wrong", ""); rsp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("wrong token: %s\n", rsp.Status)
+	}
+	for auth, want := range map[string]int{
+		"secret":        http.StatusUnauthorized,
+		"Basic secret":  http.StatusUnauthorized,
+		"bearer secret": http.StatusOK,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/nodes", nil)
+		req.Header.Set("Authorization", auth)
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		_ = rsp.Body.Close()
+		if rsp.StatusCode != want {
+			t.Fatalf("%s: %s\n", auth, rsp.Status)
+		}
+	}
+
+	rsp, body := apiRequest(t, http.MethodPost, srv.URL+"/api/subscriptions", "secret", `{"url": "`+sub.URL+`"}`)
+	if rsp.StatusCode != http.StatusCreated {
+		t.Fatalf("add subscription: %s %s\n", rsp.Status, body)
+	}
+	if rsp, _ := apiRequest(t, http.MethodPost, srv.URL+"/api/subscriptions", "secret", `{"url": "`+sub.URL+`"}`); rsp.StatusCode != http.StatusConflict {
+		t.Fatalf("add subscription again: %s\n", rsp.Status)
+	}
+
+	// 节点来自 daemon 刷新的结果
+	if err := (&daemonRunner{state: state}).RefreshSubscriptions(); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	_, body = apiRequest(t, http.MethodGet, srv.URL+"/api/subscriptions", "secret", "")
+	var subs []*apiSubscription
+	if err := json.Unmarshal(body, &subs); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if len(subs) != 1 || !subs[0].Managed || subs[0].State == nil || subs[0].State.Nodes != 2 {
+		t.Fatalf("subscriptions: %s\n", body)
+	}
+
+	_, body = apiRequest(t, http.MethodGet, srv.URL+"/api/nodes", "secret", "")
+	var nodes []*apiNode
+	if err := json.Unmarshal(body, &nodes); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if len(nodes) != 2 || nodes[1].ID != 1 || nodes[1].Name != "a#2" || nodes[1].Node.Add != "b.example.com" {
+		t.Fatalf("nodes: %s\n", body)
+	}
+
+	if rsp, _ := apiRequest(t, http.MethodGet, srv.URL+"/api/rankings", "secret", ""); rsp.StatusCode != http.StatusNotFound {
+		t.Fatalf("rankings: %s\n", rsp.Status)
+	}
+
+	rsp, body = apiRequest(t, http.MethodGet, srv.URL+"/api/export?format=singbox", "secret", "")
+	if rsp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"path": "/ws"`) {
+		t.Fatalf("export: %s %s\n", rsp.Status, body)
+	}
+	if !strings.Contains(rsp.Header.Get("X-Export-Warnings"), "a#2") {
+		t.Fatalf("export warnings: %q\n", rsp.Header.Get("X-Export-Warnings"))
+	}
+	if rsp, _ := apiRequest(t, http.MethodGet, srv.URL+"/api/export?format=nope", "secret", ""); rsp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown format: %s\n", rsp.Status)
+	}
+
+	rsp, body = apiRequest(t, http.MethodGet, srv.URL+"/metrics", "secret", "")
+	if rsp.StatusCode != http.StatusOK || !strings.Contains(string(body), "v2raybot_nodes 2") {
+		t.Fatalf("metrics: %s %s\n", rsp.Status, body)
+	}
+
+	if rsp, _ := apiRequest(t, http.MethodDelete, srv.URL+"/api/subscriptions?url="+sub.URL, "secret", ""); rsp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete subscription: %s\n", rsp.Status)
+	}
+	if rsp, _ := apiRequest(t, http.MethodGet, srv.URL+"/api/ping/unknown", "secret", ""); rsp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown job: %s\n", rsp.Status)
+	}
+}
+
+func TestAPIPingJob(t *testing.T) {
+	setXDGDir(t, "XDG_DATA_HOME", t.TempDir())
+
+	state, err := loadDaemonState()
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	srv := httptest.NewServer(newAPIServer("secret", state).Handler())
+	defer srv.Close()
+
+	// 没有节点, 任务失败
+	rsp, body := apiRequest(t, http.MethodPost, srv.URL+"/api/ping", "secret", "")
+	if rsp.StatusCode != http.StatusAccepted {
+		t.Fatalf("ping: %s %s\n", rsp.Status, body)
+	}
+	job := &pingJob{}
+	if err := json.Unmarshal(body, job); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	for i := 0; job.Status == jobRunning && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		_, body = apiRequest(t, http.MethodGet, srv.URL+rsp.Header.Get("Location"), "secret", "")
+		if err := json.Unmarshal(body, job); err != nil {
+			t.Fatalf("%s\n", err)
+		}
+	}
+	if job.Status != jobFailed || job.Error == "" || job.FinishedAt == nil {
+		t.Fatalf("job: %s\n", body)
+	}
+}
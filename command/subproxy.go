@@ -0,0 +1,260 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jdxj/v2ray-bot/logger"
+)
+
+// subFilter 是 /sub 的查询参数:
+// include, exclude 按备注过滤节点, rename 形如 pattern=>replacement, 可以有多个,
+// dead=keep 时保留测速失败的节点
+type subFilter struct {
+	include  *regexp.Regexp
+	exclude  *regexp.Regexp
+	renames  []*subRename
+	keepDead bool
+}
+
+var (
+	subInclude     string
+	nameSubInclude = "include"
+
+	subExclude     string
+	nameSubExclude = "exclude"
+
+	subRenames    []string
+	nameSubRename = "rename"
+
+	subKeepDead     bool
+	nameSubKeepDead = "keep-dead"
+)
+
+type subRename struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+func parseSubFilter(q url.Values) (*subFilter, error) {
+	f := &subFilter{keepDead: q.Get("dead") == "keep"}
+
+	var err error
+	if p := q.Get("include"); p != "" {
+		if f.include, err = regexp.Compile(p); err != nil {
+			return nil, fmt.Errorf("invalid include: %s", err)
+		}
+	}
+	if p := q.Get("exclude"); p != "" {
+		if f.exclude, err = regexp.Compile(p); err != nil {
+			return nil, fmt.Errorf("invalid exclude: %s", err)
+		}
+	}
+	for _, r := range q["rename"] {
+		pattern, replacement, ok := strings.Cut(r, "=>")
+		if !ok {
+			return nil, fmt.Errorf("invalid rename: %s, want pattern=>replacement", r)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rename: %s", err)
+		}
+		f.renames = append(f.renames, &subRename{pattern: re, replacement: replacement})
+	}
+	return f, nil
+}
+
+// withDefaultFilter 使用 --include 等参数作为请求中没有指定的过滤条件
+func withDefaultFilter(q url.Values) url.Values {
+	q = cloneValues(q)
+	if !q.Has("include") && subInclude != "" {
+		q.Set("include", subInclude)
+	}
+	if !q.Has("exclude") && subExclude != "" {
+		q.Set("exclude", subExclude)
+	}
+	if !q.Has("rename") && len(subRenames) > 0 {
+		q["rename"] = subRenames
+	}
+	if !q.Has("dead") && subKeepDead {
+		q.Set("dead", "keep")
+	}
+	return q
+}
+
+func cloneValues(q url.Values) url.Values {
+	c := make(url.Values, len(q))
+	for k, v := range q {
+		c[k] = v
+	}
+	return c
+}
+
+// Apply 按备注过滤并重命名, 不修改原来的节点
+func (f *subFilter) Apply(vmesses []*vmess) []*vmess {
+	var result []*vmess
+	for _, v := range vmesses {
+		if f.include != nil && !f.include.MatchString(v.Ps) {
+			continue
+		}
+		if f.exclude != nil && f.exclude.MatchString(v.Ps) {
+			continue
+		}
+
+		renamed := *v
+		for _, r := range f.renames {
+			renamed.Ps = r.pattern.ReplaceAllString(renamed.Ps, r.replacement)
+		}
+		result = append(result, &renamed)
+	}
+	return result
+}
+
+// dedupVmess 删除连接参数相同的节点, 保留第一个
+func dedupVmess(vmesses []*vmess) []*vmess {
+	seen := make(map[string]bool)
+	var result []*vmess
+	for _, v := range vmesses {
+		id := nodeID(v)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		result = append(result, v)
+	}
+	return result
+}
+
+// rankVmess 按最近一次排名的延迟排序, 测速失败的节点被删除,
+// 排名中没有的节点(例如新加入的)排在最后
+func rankVmess(vmesses []*vmess, ranking *rankingState, keepDead bool) []*vmess {
+	if ranking == nil {
+		return vmesses
+	}
+
+	results := make(map[string]*rankingResult, len(ranking.Results))
+	for _, r := range ranking.Results {
+		results[r.ID] = r
+	}
+
+	type ranked struct {
+		v *vmess
+		r *rankingResult
+	}
+	var nodes []ranked
+	for _, v := range vmesses {
+		r := results[nodeID(v)]
+		if r != nil && r.Error != "" && !keepDead {
+			continue
+		}
+		nodes = append(nodes, ranked{v: v, r: r})
+	}
+
+	// 依次是: 可用的按延迟排序, 没有排名的, 失败的
+	order := func(n ranked) int {
+		switch {
+		case n.r == nil:
+			return 1
+		case n.r.Error != "":
+			return 2
+		}
+		return 0
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		oi, oj := order(nodes[i]), order(nodes[j])
+		if oi != oj {
+			return oi < oj
+		}
+		return oi == 0 && nodes[i].r.DelayMs < nodes[j].r.DelayMs
+	})
+
+	result := make([]*vmess, 0, len(nodes))
+	for _, n := range nodes {
+		result = append(result, n.v)
+	}
+	return result
+}
+
+// subTarget 根据 ?target= 或 User-Agent 选择输出格式, 默认是分享链接
+func subTarget(r *http.Request) string {
+	if target := r.URL.Query().Get("target"); target != "" {
+		return target
+	}
+
+	ua := strings.ToLower(r.UserAgent())
+	switch {
+	case strings.Contains(ua, "sing-box"), strings.Contains(ua, "sfa"), strings.Contains(ua, "sfi"):
+		return formatSingbox
+	case strings.Contains(ua, "clash"), strings.Contains(ua, "stash"):
+		return formatClash
+	}
+	return formatShare
+}
+
+// handleSub 合并所有订阅, 过滤, 去重并按排名排序后重新输出
+func (s *apiServer) handleSub(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	filter, err := parseSubFilter(withDefaultFilter(r.URL.Query()))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	e, err := findExporter(subTarget(r))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	urls, err := s.subscriptionURLs()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var vmesses []*vmess
+	for _, u := range urls {
+		nodes, sub, err := parseFromURL(u)
+		if err != nil {
+			logger.Errorw("fetch subscription failed", "url", u, "err", err)
+			continue
+		}
+		if sub.Stale {
+			logger.Warnw("fetch subscription failed, using cached copy",
+				"url", u, "err", sub.Err, "age", sub.Age())
+		}
+		vmesses = append(vmesses, filterValidVmess(nodes)...)
+	}
+	if len(vmesses) == 0 {
+		writeError(w, http.StatusBadGateway, errors.New("no node from upstream subscriptions"))
+		return
+	}
+
+	var ranking *rankingState
+	if err := s.state.view(func() { ranking = s.state.Ranking }); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	vmesses = filter.Apply(rankVmess(dedupVmess(vmesses), ranking, filter.keepDead))
+	if len(vmesses) == 0 {
+		writeError(w, http.StatusNotFound, errors.New("no node left after filtering"))
+		return
+	}
+
+	data, warnings, err := e.export(vmesses)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if len(warnings) > 0 {
+		w.Header().Set("X-Export-Warnings", strings.Join(warnings, "; "))
+	}
+	w.Header().Set("Content-Type", e.contentType)
+	_, _ = w.Write(data)
+}
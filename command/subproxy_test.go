@@ -0,0 +1,156 @@
+package command
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSubProxy(t *testing.T) {
+	setXDGDir(t, "XDG_CACHE_HOME", t.TempDir())
+	setXDGDir(t, "XDG_DATA_HOME", t.TempDir())
+
+	var (
+		fast = &vmess{Ps: "HK fast", Id: "2015cdb0-4f09-4796-7ec6-91b2e5dc2923", Add: "a.example.com", Port: 443}
+		slow = &vmess{Ps: "HK slow", Id: "2015cdb0-4f09-4796-7ec6-91b2e5dc2923", Add: "b.example.com", Port: 443}
+		dead = &vmess{Ps: "HK dead", Id: "2015cdb0-4f09-4796-7ec6-91b2e5dc2923", Add: "c.example.com", Port: 443}
+		news = &vmess{Ps: "JP new", Id: "2015cdb0-4f09-4796-7ec6-91b2e5dc2923", Add: "d.example.com", Port: 443}
+	)
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(newShare(news, dead, slow))
+	}))
+	defer first.Close()
+	// 与第一个订阅重复的节点只保留一个
+	second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dup := *slow
+		dup.Ps = "dup"
+		_, _ = w.Write(newShare(&dup, fast))
+	}))
+	defer second.Close()
+
+	store, err := loadBotStore()
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	for _, u := range []string{first.URL, second.URL} {
+		if _, err := store.Add(u); err != nil {
+			t.Fatalf("%s\n", err)
+		}
+	}
+	state, err := loadDaemonState()
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	err = state.update(func() {
+		state.Ranking = &rankingState{Results: []*rankingResult{
+			{ID: nodeID(fast), DelayMs: 100},
+			{ID: nodeID(slow), DelayMs: 300},
+			{ID: nodeID(dead), Error: "timeout"},
+		}}
+	})
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	srv := httptest.NewServer(newAPIServer("secret", state).Handler())
+	defer srv.Close()
+
+	names := func(body []byte) string {
+		vmesses, err := parseFromReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		var ps []string
+		for _, v := range vmesses {
+			ps = append(ps, v.Ps)
+		}
+		return strings.Join(ps, ",")
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{query: "", want: "HK fast,HK slow,JP new"},
+		{query: "&dead=keep", want: "HK fast,HK slow,JP new,HK dead"},
+		{query: "&include=HK&exclude=slow&rename=^HK=>香港", want: "香港 fast"},
+	}
+	for _, test := range tests {
+		rsp, body := apiRequest(t, http.MethodGet, srv.URL+"/sub?token=secret"+test.query, "", "")
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: %s %s\n", test.query, rsp.Status, body)
+		}
+		if got := names(body); got != test.want {
+			t.Fatalf("%s: %s, want %s\n", test.query, got, test.want)
+		}
+	}
+
+	if rsp, _ := apiRequest(t, http.MethodGet, srv.URL+"/sub?include=none", "secret", ""); rsp.StatusCode != http.StatusNotFound {
+		t.Fatalf("filter all nodes: %s\n", rsp.Status)
+	}
+	if rsp, _ := apiRequest(t, http.MethodGet, srv.URL+"/api/nodes?token=secret", "", ""); rsp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("token in query: %s\n", rsp.Status)
+	}
+
+	// 没有 target 时按 User-Agent 选择格式
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/sub?token=secret", nil)
+	req.Header.Set("User-Agent", "ClashForAndroid/2.5.12")
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	rsp.Body.Close()
+	if ct := rsp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/yaml") {
+		t.Fatalf("content type: %s\n", ct)
+	}
+
+	// 设置了 sub-token 后 ?token= 只接受 sub-token, 它不能访问 api
+	api := newAPIServer("secret", state)
+	api.subToken = "pull-only"
+	subSrv := httptest.NewServer(api.Handler())
+	defer subSrv.Close()
+	for _, c := range []struct {
+		url, token string
+		want       int
+	}{
+		{url: subSrv.URL + "/sub?token=pull-only", want: http.StatusOK},
+		{url: subSrv.URL + "/sub?token=secret", want: http.StatusUnauthorized},
+		{url: subSrv.URL + "/sub", token: "secret", want: http.StatusOK},
+		{url: subSrv.URL + "/api/nodes", token: "pull-only", want: http.StatusUnauthorized},
+	} {
+		if rsp, _ := apiRequest(t, http.MethodGet, c.url, c.token, ""); rsp.StatusCode != c.want {
+			t.Fatalf("%s with %q: %s\n", c.url, c.token, rsp.Status)
+		}
+	}
+
+	// 同时拉取时每个订阅依次更新缓存, 缓存保持完整
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rsp, err := http.Get(subSrv.URL + "/sub?token=pull-only")
+			if err != nil {
+				t.Errorf("%s\n", err)
+				return
+			}
+			_ = rsp.Body.Close()
+			if rsp.StatusCode != http.StatusOK {
+				t.Errorf("concurrent pull: %s\n", rsp.Status)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, u := range []string{first.URL, second.URL} {
+		cached, err := loadSubscriptionCache(u)
+		if err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		if _, err := parseFromReader(bytes.NewReader(cached.Body)); err != nil {
+			t.Fatalf("cache of %s: %s\n", u, err)
+		}
+	}
+}
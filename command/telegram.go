@@ -0,0 +1,143 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	telegramAPI = "https://api.telegram.org"
+
+	// 单条消息的最大长度
+	telegramMessageLimit = 4096
+)
+
+// telegramClient 是 Telegram Bot API 的最小实现, 只包含 long polling 和发送文本消息
+type telegramClient struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func newTelegramClient(baseURL, token string, pollTimeout time.Duration) *telegramClient {
+	return &telegramClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		client: &http.Client{
+			// 比 getUpdates 的等待时间长一些
+			Timeout: pollTimeout + 10*time.Second,
+		},
+	}
+}
+
+type tgResponse struct {
+	OK          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	Description string          `json:"description"`
+}
+
+type tgChat struct {
+	ID int64 `json:"id"`
+}
+
+type tgMessage struct {
+	MessageID int64  `json:"message_id"`
+	Chat      tgChat `json:"chat"`
+	Text      string `json:"text"`
+}
+
+type tgUpdate struct {
+	UpdateID int64      `json:"update_id"`
+	Message  *tgMessage `json:"message"`
+}
+
+func (c *telegramClient) call(ctx context.Context, method string, params, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		fmt.Sprintf("%s/bot%s/%s", c.baseURL, c.token, method), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		// 错误信息中的地址包含 token
+		return fmt.Errorf("%s: %s", method, strings.ReplaceAll(err.Error(), c.token, "***"))
+	}
+	defer rsp.Body.Close()
+
+	tr := &tgResponse{}
+	if err := json.NewDecoder(rsp.Body).Decode(tr); err != nil {
+		return fmt.Errorf("%s: %s, err: %s", method, rsp.Status, err)
+	}
+	if !tr.OK {
+		return fmt.Errorf("%s: %s", method, tr.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(tr.Result, result)
+}
+
+// GetUpdates 等待新消息, 最多等待 timeout
+func (c *telegramClient) GetUpdates(ctx context.Context, offset int64, timeout time.Duration) ([]tgUpdate, error) {
+	var updates []tgUpdate
+	params := map[string]interface{}{
+		"offset":          offset,
+		"timeout":         int(timeout.Seconds()),
+		"allowed_updates": []string{"message"},
+	}
+	return updates, c.call(ctx, "getUpdates", params, &updates)
+}
+
+// SendMessage 发送文本消息, 超过长度限制时按行拆成多条
+func (c *telegramClient) SendMessage(ctx context.Context, chatID int64, text string) error {
+	for _, chunk := range splitMessage(text, telegramMessageLimit) {
+		params := map[string]interface{}{
+			"chat_id":                  chatID,
+			"text":                     chunk,
+			"disable_web_page_preview": true,
+		}
+		if err := c.call(ctx, "sendMessage", params, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func splitMessage(text string, limit int) []string {
+	var (
+		chunks []string
+		b      strings.Builder
+	)
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if b.Len() > 0 && b.Len()+len(line) > limit {
+			chunks = append(chunks, b.String())
+			b.Reset()
+		}
+		// 过长的单行在字符边界处截断
+		for len(line) > limit {
+			n := limit
+			for n > 0 && !utf8.RuneStart(line[n]) {
+				n--
+			}
+			chunks = append(chunks, line[:n])
+			line = line[n:]
+		}
+		b.WriteString(line)
+	}
+	if b.Len() > 0 {
+		chunks = append(chunks, b.String())
+	}
+	return chunks
+}
@@ -0,0 +1,270 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/cobra"
+	core "github.com/v2fly/v2ray-core/v5"
+	"github.com/v2fly/v2ray-core/v5/app/proxyman"
+	"github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/serial"
+	"github.com/v2fly/v2ray-core/v5/proxy/dokodemo"
+	"github.com/v2fly/v2ray-core/v5/transport/internet"
+)
+
+var tproxy = &cobra.Command{
+	Use:        "tproxy",
+	Aliases:    nil,
+	SuggestFor: nil,
+	Short:      "print iptables/nftables rules for run --tproxy-port",
+	Long: `example:
+  tproxy --tproxy-port 7893 > tproxy.sh && sudo sh tproxy.sh
+  tproxy --format nftables --tproxy-mode redirect
+
+the rules send lan and local traffic to the transparent inbound of
+"run --tproxy-port", traffic sent by v2ray itself is marked with --mark and skipped.`,
+	Example:                    "",
+	ValidArgs:                  nil,
+	ValidArgsFunction:          nil,
+	Args:                       cobra.NoArgs,
+	ArgAliases:                 nil,
+	BashCompletionFunction:     "",
+	Deprecated:                 "",
+	Annotations:                nil,
+	Version:                    "",
+	PersistentPreRun:           nil,
+	PersistentPreRunE:          nil,
+	PreRun:                     nil,
+	PreRunE:                    nil,
+	Run:                        tproxyRun,
+	RunE:                       nil,
+	PostRun:                    nil,
+	PostRunE:                   nil,
+	PersistentPostRun:          nil,
+	PersistentPostRunE:         nil,
+	FParseErrWhitelist:         cobra.FParseErrWhitelist{},
+	CompletionOptions:          cobra.CompletionOptions{},
+	TraverseChildren:           false,
+	Hidden:                     false,
+	SilenceErrors:              false,
+	SilenceUsage:               false,
+	DisableFlagParsing:         false,
+	DisableAutoGenTag:          false,
+	DisableFlagsInUseLine:      false,
+	DisableSuggestions:         false,
+	SuggestionsMinimumDistance: 0,
+}
+
+var (
+	tproxyPort     uint32
+	nameTproxyPort = "tproxy-port"
+
+	// tproxy 命令的默认端口与 run 不同, run 默认不开启透明代理
+	rulesTproxyPort uint32
+
+	tproxyMode     string
+	nameTproxyMode = "tproxy-mode"
+
+	outboundMark     uint32
+	nameOutboundMark = "mark"
+
+	rulesFormat     string
+	nameRulesFormat = "format"
+
+	bypassCIDRs     []string
+	nameBypassCIDRs = "bypass"
+)
+
+func init() {
+	rootCmd.AddCommand(tproxy)
+
+	tproxy.Flags().
+		Uint32Var(&rulesTproxyPort, nameTproxyPort, 7893, "port of the transparent inbound")
+
+	tproxy.Flags().
+		StringVar(&tproxyMode, nameTproxyMode, tproxyModeTProxy, "tproxy (tcp and udp) or redirect (tcp only)")
+
+	tproxy.Flags().
+		Uint32Var(&outboundMark, nameOutboundMark, 255, "SO_MARK set by v2ray on outbound connections")
+
+	tproxy.Flags().
+		StringVar(&rulesFormat, nameRulesFormat, "iptables", "iptables or nftables")
+
+	tproxy.Flags().
+		StringSliceVar(&bypassCIDRs, nameBypassCIDRs, defaultBypassCIDRs, "destinations never sent to the proxy")
+}
+
+const (
+	transparentInboundTag = "tproxy"
+
+	tproxyModeTProxy   = "tproxy"
+	tproxyModeRedirect = "redirect"
+
+	// 策略路由使用的 fwmark 和路由表
+	tproxyRouteMark  = 1
+	tproxyRouteTable = 100
+)
+
+var defaultBypassCIDRs = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+}
+
+// newTransparentInbound 生成透明代理入站, 通过 followRedirect 取得原始目标地址,
+// 并嗅探 http 和 tls 的域名以便按域名路由
+func newTransparentInbound(tag string, port uint32, mode string) (*core.InboundHandlerConfig, error) {
+	config := &dokodemo.Config{FollowRedirect: true}
+	socket := &internet.SocketConfig{}
+	switch mode {
+	case tproxyModeTProxy:
+		socket.Tproxy = internet.SocketConfig_TProxy
+		config.Networks = []net.Network{net.Network_TCP, net.Network_UDP}
+	case tproxyModeRedirect:
+		socket.Tproxy = internet.SocketConfig_Redirect
+		config.Networks = []net.Network{net.Network_TCP}
+	default:
+		return nil, fmt.Errorf("unknown tproxy mode: %s", mode)
+	}
+
+	return &core.InboundHandlerConfig{
+		Tag: tag,
+		ReceiverSettings: serial.ToTypedMessage(&proxyman.ReceiverConfig{
+			PortRange: &net.PortRange{
+				From: port,
+				To:   port,
+			},
+			// 需要接收局域网的流量, 总是监听所有地址
+			Listen: net.NewIPOrDomain(net.AnyIP),
+			StreamSettings: &internet.StreamConfig{
+				SocketSettings: socket,
+			},
+			SniffingSettings: &proxyman.SniffingConfig{
+				Enabled:             true,
+				DestinationOverride: []string{"http", "tls"},
+			},
+		}),
+		ProxySettings: serial.ToTypedMessage(config),
+	}, nil
+}
+
+// outboundSocketConfig 开启透明代理时给出站连接打上 --mark, 防止被规则再次转发回 v2ray
+func outboundSocketConfig() *internet.SocketConfig {
+	if tproxyPort == 0 || outboundMark == 0 {
+		return nil
+	}
+	return &internet.SocketConfig{Mark: outboundMark}
+}
+
+func tproxyRun(cmd *cobra.Command, args []string) {
+	var err error
+	switch rulesFormat {
+	case "iptables":
+		err = writeIptablesRules(cmd.OutOrStdout(), tproxyMode, rulesTproxyPort, outboundMark, bypassCIDRs)
+	case "nftables":
+		err = writeNftablesRules(cmd.OutOrStdout(), tproxyMode, rulesTproxyPort, outboundMark, bypassCIDRs)
+	default:
+		err = fmt.Errorf("unknown format: %s", rulesFormat)
+	}
+	if err != nil {
+		cmd.PrintErrf("write rules err: %s\n", err)
+	}
+}
+
+func writeIptablesRules(w io.Writer, mode string, port, mark uint32, bypass []string) error {
+	var b strings.Builder
+	switch mode {
+	case tproxyModeTProxy:
+		fmt.Fprintf(&b, "ip rule add fwmark %d table %d\n", tproxyRouteMark, tproxyRouteTable)
+		fmt.Fprintf(&b, "ip route add local 0.0.0.0/0 dev lo table %d\n\n", tproxyRouteTable)
+
+		b.WriteString("# 局域网流量\n")
+		b.WriteString("iptables -t mangle -N V2RAY\n")
+		for _, cidr := range bypass {
+			fmt.Fprintf(&b, "iptables -t mangle -A V2RAY -d %s -j RETURN\n", cidr)
+		}
+		for _, proto := range []string{"tcp", "udp"} {
+			fmt.Fprintf(&b, "iptables -t mangle -A V2RAY -p %s -j TPROXY --on-port %d --tproxy-mark %d\n",
+				proto, port, tproxyRouteMark)
+		}
+		b.WriteString("iptables -t mangle -A PREROUTING -j V2RAY\n\n")
+
+		b.WriteString("# 本机流量, 重新路由到 lo 后由 PREROUTING 处理\n")
+		b.WriteString("iptables -t mangle -N V2RAY_MARK\n")
+		fmt.Fprintf(&b, "iptables -t mangle -A V2RAY_MARK -m mark --mark %d -j RETURN\n", mark)
+		for _, cidr := range bypass {
+			fmt.Fprintf(&b, "iptables -t mangle -A V2RAY_MARK -d %s -j RETURN\n", cidr)
+		}
+		for _, proto := range []string{"tcp", "udp"} {
+			fmt.Fprintf(&b, "iptables -t mangle -A V2RAY_MARK -p %s -j MARK --set-mark %d\n", proto, tproxyRouteMark)
+		}
+		b.WriteString("iptables -t mangle -A OUTPUT -j V2RAY_MARK\n")
+	case tproxyModeRedirect:
+		b.WriteString("iptables -t nat -N V2RAY\n")
+		fmt.Fprintf(&b, "iptables -t nat -A V2RAY -m mark --mark %d -j RETURN\n", mark)
+		for _, cidr := range bypass {
+			fmt.Fprintf(&b, "iptables -t nat -A V2RAY -d %s -j RETURN\n", cidr)
+		}
+		fmt.Fprintf(&b, "iptables -t nat -A V2RAY -p tcp -j REDIRECT --to-ports %d\n", port)
+		b.WriteString("iptables -t nat -A PREROUTING -p tcp -j V2RAY\n")
+		b.WriteString("iptables -t nat -A OUTPUT -p tcp -j V2RAY\n")
+	default:
+		return fmt.Errorf("unknown tproxy mode: %s", mode)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeNftablesRules(w io.Writer, mode string, port, mark uint32, bypass []string) error {
+	var b strings.Builder
+	set := fmt.Sprintf("\tset bypass {\n\t\ttype ipv4_addr\n\t\tflags interval\n\t\telements = { %s }\n\t}\n",
+		strings.Join(bypass, ", "))
+
+	switch mode {
+	case tproxyModeTProxy:
+		fmt.Fprintf(&b, "# ip rule add fwmark %d table %d\n", tproxyRouteMark, tproxyRouteTable)
+		fmt.Fprintf(&b, "# ip route add local 0.0.0.0/0 dev lo table %d\n\n", tproxyRouteTable)
+		b.WriteString("table ip v2ray {\n")
+		b.WriteString(set)
+		b.WriteString("\n\tchain prerouting {\n")
+		b.WriteString("\t\ttype filter hook prerouting priority mangle; policy accept;\n")
+		b.WriteString("\t\tip daddr @bypass return\n")
+		fmt.Fprintf(&b, "\t\tmeta l4proto { tcp, udp } tproxy to :%d meta mark set %d\n", port, tproxyRouteMark)
+		b.WriteString("\t}\n")
+		b.WriteString("\n\tchain output {\n")
+		b.WriteString("\t\ttype route hook output priority mangle; policy accept;\n")
+		fmt.Fprintf(&b, "\t\tmeta mark %d return\n", mark)
+		b.WriteString("\t\tip daddr @bypass return\n")
+		fmt.Fprintf(&b, "\t\tmeta l4proto { tcp, udp } meta mark set %d\n", tproxyRouteMark)
+		b.WriteString("\t}\n")
+		b.WriteString("}\n")
+	case tproxyModeRedirect:
+		b.WriteString("table ip v2ray {\n")
+		b.WriteString(set)
+		b.WriteString("\n\tchain prerouting {\n")
+		b.WriteString("\t\ttype nat hook prerouting priority dstnat; policy accept;\n")
+		b.WriteString("\t\tip daddr @bypass return\n")
+		fmt.Fprintf(&b, "\t\tmeta l4proto tcp redirect to :%d\n", port)
+		b.WriteString("\t}\n")
+		b.WriteString("\n\tchain output {\n")
+		b.WriteString("\t\ttype nat hook output priority -100; policy accept;\n")
+		fmt.Fprintf(&b, "\t\tmeta mark %d return\n", mark)
+		b.WriteString("\t\tip daddr @bypass return\n")
+		fmt.Fprintf(&b, "\t\tmeta l4proto tcp redirect to :%d\n", port)
+		b.WriteString("\t}\n")
+		b.WriteString("}\n")
+	default:
+		return fmt.Errorf("unknown tproxy mode: %s", mode)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
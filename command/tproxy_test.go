@@ -0,0 +1,63 @@
+package command
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteTproxyRules(t *testing.T) {
+	bypass := []string{"10.0.0.0/8", "192.168.0.0/16"}
+	cases := []struct {
+		write func(b *strings.Builder, mode string) error
+		mode  string
+		want  []string
+	}{
+		{
+			write: func(b *strings.Builder, mode string) error { return writeIptablesRules(b, mode, 7893, 255, bypass) },
+			mode:  tproxyModeTProxy,
+			want: []string{
+				"ip rule add fwmark 1 table 100",
+				"iptables -t mangle -A V2RAY -d 192.168.0.0/16 -j RETURN",
+				"iptables -t mangle -A V2RAY -p udp -j TPROXY --on-port 7893 --tproxy-mark 1",
+				"iptables -t mangle -A V2RAY_MARK -m mark --mark 255 -j RETURN",
+			},
+		},
+		{
+			write: func(b *strings.Builder, mode string) error { return writeIptablesRules(b, mode, 7893, 255, bypass) },
+			mode:  tproxyModeRedirect,
+			want: []string{
+				"iptables -t nat -A V2RAY -p tcp -j REDIRECT --to-ports 7893",
+				"iptables -t nat -A OUTPUT -p tcp -j V2RAY",
+			},
+		},
+		{
+			write: func(b *strings.Builder, mode string) error { return writeNftablesRules(b, mode, 7893, 255, bypass) },
+			mode:  tproxyModeTProxy,
+			want: []string{
+				"elements = { 10.0.0.0/8, 192.168.0.0/16 }",
+				"meta l4proto { tcp, udp } tproxy to :7893 meta mark set 1",
+				"meta mark 255 return",
+			},
+		},
+		{
+			write: func(b *strings.Builder, mode string) error { return writeNftablesRules(b, mode, 7893, 255, bypass) },
+			mode:  tproxyModeRedirect,
+			want:  []string{"meta l4proto tcp redirect to :7893"},
+		},
+	}
+
+	for i, c := range cases {
+		b := &strings.Builder{}
+		if err := c.write(b, c.mode); err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		for _, line := range c.want {
+			if !strings.Contains(b.String(), line) {
+				t.Fatalf("case %d missing %q in:\n%s\n", i, line, b)
+			}
+		}
+		if err := c.write(&strings.Builder{}, "unknown"); err == nil {
+			t.Fatalf("case %d accepted unknown mode\n", i)
+		}
+	}
+}
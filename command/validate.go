@@ -0,0 +1,164 @@
+package command
+
+import (
+	"fmt"
+
+	"github.com/jdxj/v2ray-bot/logger"
+	"github.com/spf13/cobra"
+	"github.com/v2fly/v2ray-core/v5/common/uuid"
+)
+
+var validate = &cobra.Command{
+	Use:        "validate",
+	Aliases:    nil,
+	SuggestFor: nil,
+	Short:      "check parsed nodes before use",
+	Long: `example:
+  validate --vmess-file vmess.txt`,
+	Example:                    "",
+	ValidArgs:                  nil,
+	ValidArgsFunction:          nil,
+	Args:                       nil,
+	ArgAliases:                 nil,
+	BashCompletionFunction:     "",
+	Deprecated:                 "",
+	Annotations:                nil,
+	Version:                    "",
+	PersistentPreRun:           nil,
+	PersistentPreRunE:          nil,
+	PreRun:                     nil,
+	PreRunE:                    nil,
+	Run:                        validateRun,
+	RunE:                       nil,
+	PostRun:                    nil,
+	PostRunE:                   nil,
+	PersistentPostRun:          nil,
+	PersistentPostRunE:         nil,
+	FParseErrWhitelist:         cobra.FParseErrWhitelist{},
+	CompletionOptions:          cobra.CompletionOptions{},
+	TraverseChildren:           false,
+	Hidden:                     false,
+	SilenceErrors:              false,
+	SilenceUsage:               false,
+	DisableFlagParsing:         false,
+	DisableAutoGenTag:          false,
+	DisableFlagsInUseLine:      false,
+	DisableSuggestions:         false,
+	SuggestionsMinimumDistance: 0,
+}
+
+func init() {
+	rootCmd.AddCommand(validate)
+
+	validate.Flags().
+		StringVar(&vmessFile, nameVmessFile, "vmess.txt", "parsed vmess config (parse cmd)")
+}
+
+var knownNets = map[string]bool{
+	"":     true,
+	"tcp":  true,
+	"kcp":  true,
+	"ws":   true,
+	"h2":   true,
+	"http": true,
+	"quic": true,
+	"grpc": true,
+}
+
+// validateVmess 返回节点配置中的所有问题, 没有问题时返回 nil
+func validateVmess(v *vmess) []string {
+	var problems []string
+	if _, err := uuid.ParseString(v.Id); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid id %q: %s", v.Id, err))
+	}
+	if v.Add == "" {
+		problems = append(problems, "empty address")
+	}
+	if v.Port == 0 || v.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("invalid port %d", v.Port))
+	}
+	if !knownNets[v.Net] {
+		problems = append(problems, fmt.Sprintf("unknown net %q", v.Net))
+	}
+	if v.Tls != "" && v.Tls != "tls" {
+		problems = append(problems, fmt.Sprintf("unknown tls %q", v.Tls))
+	}
+	return problems
+}
+
+// tcpTypes 是 newTCPConfig 支持的伪装类型, 空值使用 http 伪装
+var tcpTypes = map[string]bool{
+	"":     true,
+	"none": true,
+	"http": true,
+}
+
+// outboundProblems 返回 newOutboundConfig 无法构建的配置, 目前只支持没有 tls 的 tcp,
+// 这些节点仍然可以订阅和导出, 但是 ping 和 run 无法使用
+func outboundProblems(v *vmess) []string {
+	var problems []string
+	if v.Net != "" && v.Net != "tcp" {
+		problems = append(problems, fmt.Sprintf("net %q is not supported by ping and run", v.Net))
+	} else if !tcpTypes[v.Type] {
+		problems = append(problems, fmt.Sprintf("tcp type %q is not supported by ping and run", v.Type))
+	}
+	if v.Tls != "" {
+		problems = append(problems, "tls is not supported by ping and run")
+	}
+	return problems
+}
+
+// filterSupportedVmess 记录无法构建出站的节点并将其剔除, 避免被当作失效的节点
+func filterSupportedVmess(vmesses []*vmess) []*vmess {
+	var supported []*vmess
+	for _, v := range vmesses {
+		problems := outboundProblems(v)
+		if len(problems) == 0 {
+			supported = append(supported, v)
+			continue
+		}
+		for _, p := range problems {
+			logger.Warnw("skip unsupported node", "node", nodeKey(v), "reason", p)
+		}
+	}
+	return supported
+}
+
+// filterValidVmess 记录无效节点的原因并将其剔除
+func filterValidVmess(vmesses []*vmess) []*vmess {
+	var valid []*vmess
+	for _, v := range vmesses {
+		problems := validateVmess(v)
+		if len(problems) == 0 {
+			valid = append(valid, v)
+			continue
+		}
+		for _, p := range problems {
+			logger.Warnw("skip invalid node", "node", nodeKey(v), "reason", p)
+		}
+	}
+	return valid
+}
+
+func validateRun(cmd *cobra.Command, args []string) {
+	vmesses, err := getVmessFromFile()
+	if err != nil {
+		cmd.PrintErrf("get vmess err: %s\n", err)
+		return
+	}
+
+	w := redactedOut(cmd)
+	invalid := 0
+	for _, v := range vmesses {
+		problems := append(validateVmess(v), outboundProblems(v)...)
+		if len(problems) == 0 {
+			continue
+		}
+		invalid++
+		_, _ = fmt.Fprintf(w, "%s:\n", nodeKey(v))
+		for _, p := range problems {
+			_, _ = fmt.Fprintf(w, "    %s\n", p)
+		}
+	}
+	cmd.Printf("%d/%d nodes valid\n", len(vmesses)-invalid, len(vmesses))
+}
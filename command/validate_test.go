@@ -0,0 +1,74 @@
+package command
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateVmess(t *testing.T) {
+	const id = "2015cdb0-4f09-4796-7ec6-91b2e5dc2923"
+	cases := []struct {
+		name string
+		v    *vmess
+		want string
+	}{
+		{name: "valid", v: &vmess{Id: id, Add: "a.example.com", Port: 443, Net: "ws", Tls: "tls"}},
+		{name: "valid default net", v: &vmess{Id: id, Add: "a.example.com", Port: 80}},
+		{name: "zero port", v: &vmess{Id: id, Add: "a.example.com"}, want: "invalid port 0"},
+		{name: "large port", v: &vmess{Id: id, Add: "a.example.com", Port: 65536}, want: "invalid port 65536"},
+		{name: "bad uuid", v: &vmess{Id: "2015cdb0", Add: "a.example.com", Port: 443}, want: `invalid id "2015cdb0"`},
+		{name: "empty uuid", v: &vmess{Add: "a.example.com", Port: 443}, want: `invalid id ""`},
+		{name: "unknown net", v: &vmess{Id: id, Add: "a.example.com", Port: 443, Net: "udp"}, want: `unknown net "udp"`},
+		{name: "unknown tls", v: &vmess{Id: id, Add: "a.example.com", Port: 443, Tls: "xtls"}, want: `unknown tls "xtls"`},
+		{name: "empty add", v: &vmess{Id: id, Port: 443}, want: "empty address"},
+	}
+	for _, c := range cases {
+		problems := validateVmess(c.v)
+		if c.want == "" {
+			if len(problems) != 0 {
+				t.Fatalf("%s: problems: %v\n", c.name, problems)
+			}
+			continue
+		}
+		if len(problems) != 1 || !strings.HasPrefix(problems[0], c.want) {
+			t.Fatalf("%s: problems: %v, want: %s\n", c.name, problems, c.want)
+		}
+	}
+
+	vmesses := []*vmess{cases[0].v, cases[2].v, cases[1].v}
+	if valid := filterValidVmess(vmesses); len(valid) != 2 || valid[1] != cases[1].v {
+		t.Fatalf("valid: %v\n", valid)
+	}
+}
+
+func TestOutboundProblems(t *testing.T) {
+	const id = "2015cdb0-4f09-4796-7ec6-91b2e5dc2923"
+	cases := []struct {
+		name string
+		v    *vmess
+		want []string
+	}{
+		{name: "default", v: &vmess{Id: id, Add: "a.example.com", Port: 443}},
+		{name: "http header", v: &vmess{Id: id, Add: "a.example.com", Port: 443, Net: "tcp", Type: "http"}},
+		{name: "no header", v: &vmess{Id: id, Add: "a.example.com", Port: 443, Net: "tcp", Type: "none"}},
+		{name: "ws", v: &vmess{Id: id, Add: "a.example.com", Port: 443, Net: "ws", Tls: "tls"},
+			want: []string{`net "ws" is not supported by ping and run`, "tls is not supported by ping and run"}},
+		{name: "srtp", v: &vmess{Id: id, Add: "a.example.com", Port: 443, Type: "srtp"},
+			want: []string{`tcp type "srtp" is not supported by ping and run`}},
+	}
+	for _, c := range cases {
+		if problems := outboundProblems(c.v); !reflect.DeepEqual(problems, c.want) {
+			t.Fatalf("%s: problems: %q, want: %q\n", c.name, problems, c.want)
+		}
+	}
+
+	// 不支持的节点不会被当作失效的节点参与测速
+	vmesses := []*vmess{cases[3].v, cases[0].v, cases[4].v}
+	if supported := filterSupportedVmess(vmesses); len(supported) != 1 || supported[0] != cases[0].v {
+		t.Fatalf("supported: %v\n", supported)
+	}
+	if _, err := pingVmesses([]*vmess{cases[3].v}, "http://127.0.0.1/"); err == nil {
+		t.Fatalf("want err for unsupported nodes\n")
+	}
+}
@@ -0,0 +1,16 @@
+package command
+
+import (
+	"testing"
+
+	"github.com/adrg/xdg"
+)
+
+// setXDGDir 把 xdg 目录 name 设置为 dir, 测试结束后恢复环境变量和 xdg 缓存的路径
+func setXDGDir(t *testing.T, name, dir string) {
+	t.Helper()
+	// 先注册, 在 t.Setenv 恢复环境变量之后执行
+	t.Cleanup(xdg.Reload)
+	t.Setenv(name, dir)
+	xdg.Reload()
+}
@@ -1,7 +0,0 @@
-package config
-
-var (
-	Domain string
-	Port   uint32
-	Id     string
-)
@@ -1,19 +1,142 @@
 package logger
 
-import "go.uber.org/zap"
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	FormatConsole = "console"
+	FormatJSON    = "json"
+)
 
 var (
-	logger *zap.SugaredLogger
+	level  = zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	format = FormatConsole
+	output = zapcore.Lock(os.Stderr)
+	logger = newLogger()
+
+	// redact 在输出前隐藏密钥
+	redact = func(s string) string { return s }
 )
 
-func init() {
-	l, err := zap.NewProduction()
-	if err != nil {
-		panic(err)
+func newLogger() *zap.SugaredLogger {
+	cfg := zap.NewProductionEncoderConfig()
+	cfg.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	var enc zapcore.Encoder
+	if format == FormatJSON {
+		enc = zapcore.NewJSONEncoder(cfg)
+	} else {
+		cfg.EncodeLevel = zapcore.CapitalLevelEncoder
+		enc = zapcore.NewConsoleEncoder(cfg)
+	}
+	core := zapcore.NewCore(enc, output, level)
+	return zap.New(&redactCore{Core: core}).Sugar()
+}
+
+// Init 设置日志级别和格式, level 为 debug, info, warn 或 error, format 为 console 或 json
+func Init(lvl, f string) error {
+	var l zapcore.Level
+	if err := l.UnmarshalText([]byte(lvl)); err != nil {
+		return fmt.Errorf("invalid log level: %s", lvl)
+	}
+	if f != FormatConsole && f != FormatJSON {
+		return fmt.Errorf("invalid log format: %s, supported: %s, %s", f, FormatConsole, FormatJSON)
 	}
-	logger = l.Sugar()
+	level.SetLevel(l)
+	format = f
+	logger = newLogger()
+	return nil
+}
+
+// SetOutput 设置日志的输出, 默认是 stderr
+func SetOutput(w io.Writer) {
+	output = zapcore.Lock(zapcore.AddSync(w))
+	logger = newLogger()
+}
+
+// Level 返回当前的日志级别
+func Level() zapcore.Level {
+	return level.Level()
+}
+
+// SetRedact 设置隐藏日志中密钥的方法
+func SetRedact(f func(string) string) {
+	redact = f
+}
+
+// Named 返回带有名字的 logger, 例如 v2ray-core 的日志
+func Named(name string) *zap.SugaredLogger {
+	return logger.Named(name)
+}
+
+// With 返回带有字段的 logger, 例如节点的 tag 和地址
+func With(keysAndValues ...interface{}) *zap.SugaredLogger {
+	return logger.With(keysAndValues...)
+}
+
+func Debugw(msg string, keysAndValues ...interface{}) {
+	logger.Debugw(msg, keysAndValues...)
+}
+
+func Infow(msg string, keysAndValues ...interface{}) {
+	logger.Infow(msg, keysAndValues...)
+}
+
+func Warnw(msg string, keysAndValues ...interface{}) {
+	logger.Warnw(msg, keysAndValues...)
+}
+
+func Errorw(msg string, keysAndValues ...interface{}) {
+	logger.Errorw(msg, keysAndValues...)
 }
 
 func Errorf(format string, args ...interface{}) {
 	logger.Errorf(format, args...)
 }
+
+// redactCore 隐藏消息和字符串字段中的密钥
+type redactCore struct {
+	zapcore.Core
+}
+
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	result := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		switch {
+		case f.Type == zapcore.StringType:
+			f.String = redact(f.String)
+		case f.Type == zapcore.ErrorType:
+			if err, ok := f.Interface.(error); ok {
+				f = zap.String(f.Key, redact(err.Error()))
+			}
+		case f.Type == zapcore.StringerType:
+			if s, ok := f.Interface.(fmt.Stringer); ok {
+				f = zap.String(f.Key, redact(s.String()))
+			}
+		}
+		result[i] = f
+	}
+	return result
+}
+
+func (c *redactCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactCore{Core: c.Core.With(redactFields(fields))}
+}
+
+func (c *redactCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *redactCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	ent.Message = redact(ent.Message)
+	return c.Core.Write(ent, redactFields(fields))
+}
@@ -22,8 +22,13 @@ import (
 	transHttp "github.com/v2fly/v2ray-core/v5/transport/internet/headers/http"
 	"github.com/v2fly/v2ray-core/v5/transport/internet/tcp"
 	"google.golang.org/protobuf/types/known/anypb"
+)
 
-	"github.com/jdxj/v2ray-bot/config"
+// 手动测试时填写节点信息
+var (
+	domain string
+	port   uint32
+	id     string
 )
 
 func TestCreateV2rayByManual(t *testing.T) {
@@ -143,14 +148,14 @@ func TestCreateV2rayByManual(t *testing.T) {
 				}),
 				ProxySettings: serial.ToTypedMessage(&outbound.Config{Receiver: []*protocol.ServerEndpoint{
 					&protocol.ServerEndpoint{
-						Address: &net.IPOrDomain{Address: &net.IPOrDomain_Domain{Domain: config.Domain}},
-						Port:    config.Port,
+						Address: &net.IPOrDomain{Address: &net.IPOrDomain_Domain{Domain: domain}},
+						Port:    port,
 						User: []*protocol.User{
 							&protocol.User{
 								Level: 0,
 								Email: "",
 								Account: serial.ToTypedMessage(&vmess.Account{
-									Id:               config.Id,
+									Id:               id,
 									AlterId:          0,
 									SecuritySettings: &protocol.SecurityConfig{Type: protocol.SecurityType_AUTO},
 									TestsEnabled:     "",